@@ -0,0 +1,427 @@
+/* Gavin Langdon
+ * Network Programming
+ * Spring 2013
+ * Chat server
+ */
+
+// Authenticators check a username and password for the dispatcher. Which one
+// is used is picked with the -auth flag:
+//
+//   memory              first login registers the password (the default)
+//   htpasswd:FILE       user:hash lines, hashes in {SHA}, {SSHA}, SCRAM-SHA-256
+//                       or plain text
+//   exec:COMMAND        a helper process speaking the line protocol below
+//   directory:HOST:PORT a directory server speaking the line protocol below
+//
+// The helper process and the directory server both take lines of the form
+// `BIND username password' and reply `OK' or `ERROR reason'.
+//
+// Authenticators are called from their own goroutines, never the dispatcher's,
+// since a helper or directory server can take a while to answer. They have to
+// be safe for concurrent use.
+//
+// Only memory and htpasswd (for SCRAM-SHA-256 or plain text entries) can give
+// out the credentials AUTH SCRAM-SHA-256 needs.
+
+package main
+
+import (
+  "bufio"
+  "bytes"
+  "crypto/sha1"
+  "crypto/subtle"
+  "encoding/base64"
+  "errors"
+  "fmt"
+  "io"
+  "net"
+  "os"
+  "os/exec"
+  "strings"
+  "sync"
+  "time"
+  "unicode"
+  // This is working but it requires a go get
+  //"code.google.com/p/go.crypto/bcrypt"
+)
+
+// How long to wait on a helper process or directory server
+const AuthTimeout = 5 * time.Second
+
+type Authenticator interface {
+  // Returns nil if the password is right for the user
+  Authenticate(username string, password []byte) error
+}
+
+// Build an authenticator from a -auth flag value
+func NewAuthenticator(spec string) (Authenticator, error) {
+  kind, arg := spec, ""
+  if i := strings.Index(spec, ":"); i >= 0 {
+    kind, arg = spec[:i], spec[i+1:]
+  }
+
+  switch kind {
+  case "memory":
+    return NewMemoryAuthenticator(), nil
+  case "htpasswd":
+    return NewHtpasswdAuthenticator(arg)
+  case "exec":
+    return NewCommandAuthenticator(arg)
+  case "directory":
+    return &DirectoryAuthenticator{arg}, nil
+  }
+  return nil, errors.New("Unknown authentication backend " + kind)
+}
+
+// Read user:secret lines, skipping blanks and # comments
+func readPasswordFile(path string) (map[string] string, error) {
+  file, err := os.Open(path)
+  if err != nil {
+    return nil, err
+  }
+  defer file.Close()
+
+  users := make(map[string] string)
+  scanner := bufio.NewScanner(file)
+  for scanner.Scan() {
+    line := strings.TrimSpace(scanner.Text())
+    if line == "" || line[0] == '#' {
+      continue
+    }
+    spl := strings.SplitN(line, ":", 2)
+    if len(spl) != 2 {
+      return nil, errors.New("Malformed line in " + path + ": " + line)
+    }
+    users[spl[0]] = spl[1]
+  }
+  return users, scanner.Err()
+}
+
+//////////////////////////////////////////////////
+// In memory--the first login for a username sets its password
+
+type MemoryAuthenticator struct {
+  mu sync.Mutex
+  passwords map[string] []byte
+  scram map[string] *ScramCredentials
+}
+
+func NewMemoryAuthenticator() *MemoryAuthenticator {
+  return &MemoryAuthenticator{passwords: make(map[string] []byte), scram: make(map[string] *ScramCredentials)}
+}
+
+// Users have to register with USER before they can use SCRAM
+func (a *MemoryAuthenticator) ScramCredentials(username string) (*ScramCredentials, error) {
+  a.mu.Lock()
+  defer a.mu.Unlock()
+
+  if creds := a.scram[username]; creds != nil {
+    return creds, nil
+  }
+  password, hit := a.passwords[username]
+  if !hit {
+    return fakeScramCredentials(username), nil
+  }
+
+  creds, err := NewScramCredentials(password)
+  if err != nil {
+    return nil, err
+  }
+  a.scram[username] = creds
+  return creds, nil
+}
+
+func (a *MemoryAuthenticator) Authenticate(username string, password []byte) error {
+  a.mu.Lock()
+  defer a.mu.Unlock()
+
+  stored, hit := a.passwords[username]
+  if !hit {
+    /*crypt, err := bcrypt.GenerateFromPassword(password, 0)
+    if err != nil {
+      return err
+    }*/
+    a.passwords[username] = password
+    return nil
+  }
+
+  //if bcrypt.CompareHashAndPassword(stored, password) != nil {
+  if bytes.Compare(stored, password) != 0 {
+    return ErrBadPassword
+  }
+  return nil
+}
+
+//////////////////////////////////////////////////
+// htpasswd-style file, reread when it changes
+
+type HtpasswdAuthenticator struct {
+  mu sync.Mutex
+  path string
+  modTime time.Time
+  hashes map[string] string
+
+  // Credentials worked out from plain text passwords, until the file changes
+  scram map[string] *ScramCredentials
+}
+
+func NewHtpasswdAuthenticator(path string) (*HtpasswdAuthenticator, error) {
+  a := &HtpasswdAuthenticator{path: path}
+  if err := a.reload(); err != nil {
+    return nil, err
+  }
+  return a, nil
+}
+
+func (a *HtpasswdAuthenticator) reload() error {
+  info, err := os.Stat(a.path)
+  if err != nil {
+    return err
+  }
+  if a.hashes != nil && info.ModTime().Equal(a.modTime) {
+    return nil
+  }
+
+  hashes, err := readPasswordFile(a.path)
+  if err != nil {
+    return err
+  }
+  a.hashes = hashes
+  a.modTime = info.ModTime()
+  a.scram = make(map[string] *ScramCredentials)
+  return nil
+}
+
+// The hash for a user, rereading the file first if it's changed
+func (a *HtpasswdAuthenticator) lookup(username string) (string, bool) {
+  a.mu.Lock()
+  defer a.mu.Unlock()
+
+  // Keep using the old contents if the file is briefly unreadable
+  if err := a.reload(); err != nil {
+    fmt.Println("Could not reload", a.path+":", err)
+  }
+  hash, hit := a.hashes[username]
+  return hash, hit
+}
+
+func (a *HtpasswdAuthenticator) Authenticate(username string, password []byte) error {
+  hash, hit := a.lookup(username)
+  if !hit || !checkHtpasswdHash(hash, password) {
+    return ErrBadPassword
+  }
+  return nil
+}
+
+func (a *HtpasswdAuthenticator) ScramCredentials(username string) (*ScramCredentials, error) {
+  hash, hit := a.lookup(username)
+  if !hit {
+    return fakeScramCredentials(username), nil
+  }
+  if strings.HasPrefix(hash, ScramMechanism + "$") {
+    return ParseScramCredentials(hash)
+  }
+  if strings.HasPrefix(hash, "{") || strings.HasPrefix(hash, "$") {
+    return nil, NewChatError(CodeAuthDisabled, "Password for " + username + " is not stored in a form SCRAM can use")
+  }
+
+  // Plain text. The salt is the same kind a made up user gets, so the two
+  // can't be told apart
+  a.mu.Lock()
+  defer a.mu.Unlock()
+  if creds := a.scram[username]; creds != nil {
+    return creds, nil
+  }
+  creds := deriveScramCredentials([]byte(hash), scramSalt(username), ScramIterations)
+  a.scram[username] = creds
+  return creds, nil
+}
+
+func checkHtpasswdHash(hash string, password []byte) bool {
+  switch {
+  case strings.HasPrefix(hash, ScramMechanism + "$"):
+    creds, err := ParseScramCredentials(hash)
+    return err == nil && creds.Check(password)
+
+  case strings.HasPrefix(hash, "{SHA}"):
+    sum := sha1.Sum(password)
+    return subtle.ConstantTimeCompare([]byte(hash[5:]),
+      []byte(base64.StdEncoding.EncodeToString(sum[:]))) == 1
+
+  case strings.HasPrefix(hash, "{SSHA}"):
+    // Digest followed by the salt
+    raw, err := base64.StdEncoding.DecodeString(hash[6:])
+    if err != nil || len(raw) <= sha1.Size {
+      return false
+    }
+    sum := sha1.Sum(append(append([]byte{}, password...), raw[sha1.Size:]...))
+    return subtle.ConstantTimeCompare(raw[:sha1.Size], sum[:]) == 1
+
+  case strings.HasPrefix(hash, "$"):
+    // crypt-style hashes (bcrypt, apr1, ...) need more than the standard library
+    return false
+  }
+
+  // Plain text
+  return subtle.ConstantTimeCompare([]byte(hash), password) == 1
+}
+
+//////////////////////////////////////////////////
+// External helper process, started on first use and restarted if it dies
+
+type CommandAuthenticator struct {
+  command []string
+
+  // One login at a time talks to the helper
+  mu sync.Mutex
+  cmd *exec.Cmd
+  stdin io.WriteCloser
+  lines chan string
+}
+
+func NewCommandAuthenticator(command string) (*CommandAuthenticator, error) {
+  fields := strings.Fields(command)
+  if len(fields) == 0 {
+    return nil, errors.New("No authentication command specified")
+  }
+  return &CommandAuthenticator{command: fields}, nil
+}
+
+func (a *CommandAuthenticator) start() error {
+  cmd := exec.Command(a.command[0], a.command[1:]...)
+  cmd.Stderr = os.Stderr
+  stdin, err := cmd.StdinPipe()
+  if err != nil {
+    return err
+  }
+  stdout, err := cmd.StdoutPipe()
+  if err != nil {
+    return err
+  }
+  if err := cmd.Start(); err != nil {
+    return err
+  }
+
+  // Read replies in their own goroutine so we can time out waiting on them
+  lines := make(chan string)
+  go func() {
+    scanner := bufio.NewScanner(stdout)
+    for scanner.Scan() {
+      lines <- scanner.Text()
+    }
+    close(lines)
+  }()
+
+  a.cmd, a.stdin, a.lines = cmd, stdin, lines
+  return nil
+}
+
+func (a *CommandAuthenticator) stop() {
+  a.stdin.Close()
+  a.cmd.Process.Kill()
+  go a.cmd.Wait()
+  a.cmd = nil
+}
+
+func (a *CommandAuthenticator) Authenticate(username string, password []byte) error {
+  a.mu.Lock()
+  defer a.mu.Unlock()
+
+  request, err := bindRequest(username, password)
+  if err != nil {
+    return err
+  }
+
+  // A reply nobody asked for means we can't tell which reply goes with
+  // which request any more, so start over with a fresh helper
+  if a.cmd != nil {
+    select {
+    case line, ok := <-a.lines:
+      if ok {
+        fmt.Println("Authentication helper sent an unexpected reply:", line)
+      }
+      a.stop()
+    default:
+    }
+  }
+
+  if a.cmd == nil {
+    if err := a.start(); err != nil {
+      fmt.Println("Could not start authentication helper:", err)
+      return ErrAuthUnavailable
+    }
+  }
+
+  _, err = io.WriteString(a.stdin, request)
+  if err == nil {
+    select {
+    case line, ok := <-a.lines:
+      if !ok {
+        err = errors.New("helper exited")
+      } else if err = parseBindReply(line); err != ErrAuthUnavailable {
+        return err
+      } else {
+        err = errors.New("unexpected reply " + line)
+      }
+    case <-time.After(AuthTimeout):
+      err = errors.New("helper timed out")
+    }
+  }
+
+  fmt.Println("Authentication helper failed:", err)
+  a.stop()
+  return ErrAuthUnavailable
+}
+
+// The BIND line for a login. Anything that could end the line early, and
+// smuggle in a request of its own, is refused
+func bindRequest(username string, password []byte) (string, error) {
+  if strings.IndexFunc(username, unicode.IsControl) >= 0 || bytes.IndexFunc(password, unicode.IsControl) >= 0 {
+    return "", ErrBadPassword
+  }
+  return "BIND " + username + " " + string(password) + "\n", nil
+}
+
+// OK or ERROR, anything else means the other end isn't making sense
+func parseBindReply(line string) error {
+  line = strings.TrimSpace(line)
+  if line == "OK" {
+    return nil
+  }
+  if line == "ERROR" || strings.HasPrefix(line, "ERROR ") {
+    return ErrBadPassword
+  }
+  return ErrAuthUnavailable
+}
+
+//////////////////////////////////////////////////
+// Directory server, one connection per login
+
+type DirectoryAuthenticator struct {
+  addr string
+}
+
+func (a *DirectoryAuthenticator) Authenticate(username string, password []byte) error {
+  request, err := bindRequest(username, password)
+  if err != nil {
+    return err
+  }
+
+  conn, err := net.DialTimeout("tcp", a.addr, AuthTimeout)
+  if err != nil {
+    fmt.Println("Could not reach directory server:", err)
+    return ErrAuthUnavailable
+  }
+  defer conn.Close()
+  conn.SetDeadline(time.Now().Add(AuthTimeout))
+
+  if _, err := io.WriteString(conn, request); err != nil {
+    return ErrAuthUnavailable
+  }
+  line, err := bufio.NewReader(conn).ReadString('\n')
+  if err != nil {
+    fmt.Println("Directory server failed:", err)
+    return ErrAuthUnavailable
+  }
+  return parseBindReply(line)
+}
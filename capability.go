@@ -0,0 +1,90 @@
+/* Gavin Langdon
+ * Network Programming
+ * Spring 2013
+ * Chat server
+ */
+
+// Protocol versions and capabilities. Clients turn capabilities on with
+// `CHAT version cap cap...'; until they do they get the original protocol
+
+package main
+
+import (
+  "strconv"
+)
+
+// Version 1 is the original protocol with no capabilities
+const ProtocolVersion = 2
+
+const (
+  CapCodes = "codes"   // reply codes on responses
+  CapTags = "tags"     // #tags on requests echoed on responses
+  CapResume = "resume" // session tokens and RESUME
+  CapScram = "scram"   // AUTH and PROOF
+  CapJSON = "json"     // JSON objects instead of lines, from the TAHC response on
+  CapBinary = "binary" // length-prefixed frames instead of lines, TCP only
+  CapMsgId = "msgid"   // IDs and timestamps on messages, and HISTORY
+  CapReceipts = "receipts" // ACK and READ for direct messages, needs msgid
+  CapKinds = "kinds"   // ACTION, NOTICE and SYSTEM messages
+  CapMentions = "mentions" // MENTION events and MENTIONS
+  CapFiles = "files"   // SENDFILE, DATA and GETFILE
+  CapPresence = "presence" // AWAY, STATUS, states in USERS and LIST, PRESENCE events
+)
+
+// Everything this server can do, in the order we advertise it
+var Capabilities = []string{CapCodes, CapTags, CapResume, CapScram, CapJSON, CapBinary, CapMsgId,
+  CapReceipts, CapKinds, CapMentions, CapFiles, CapPresence}
+
+func SupportsCapability(capability string) bool {
+  return contains(Capabilities, capability)
+}
+
+// Parse a CHAT request's version and capabilities, keeping only the ones
+// we support at the version both sides understand
+func NegotiateCapabilities(args []string) (int, []string, error) {
+  if len(args) == 0 {
+    return 0, nil, NewChatError(CodeBadRequest, "Invalid protocol version")
+  }
+  version, err := strconv.Atoi(args[0])
+  if err != nil || version < 1 {
+    return 0, nil, NewChatError(CodeBadRequest, "Invalid protocol version")
+  }
+  if version > ProtocolVersion {
+    version = ProtocolVersion
+  }
+
+  var caps []string
+  framings := 0
+  if version >= 2 {
+    for _, c := range args[1:] {
+      if SupportsCapability(c) {
+        caps = append(caps, c)
+      }
+      if c == CapJSON || c == CapBinary {
+        framings++
+      }
+    }
+  }
+  if framings > 1 {
+    return 0, nil, NewChatError(CodeBadRequest, "Only one of json and binary can be on")
+  }
+  // Receipts name messages by ID
+  if contains(caps, CapReceipts) && !contains(caps, CapMsgId) {
+    return 0, nil, NewChatError(CodeBadRequest, "receipts needs msgid")
+  }
+  return version, caps, nil
+}
+
+func contains(list []string, s string) bool {
+  for _, item := range list {
+    if item == s {
+      return true
+    }
+  }
+  return false
+}
+
+// Whether the client has turned on a capability
+func (cl *Client) Has(capability string) bool {
+  return cl.caps[capability]
+}
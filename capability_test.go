@@ -0,0 +1,47 @@
+/* Gavin Langdon
+ * Network Programming
+ * Spring 2013
+ * Chat server
+ */
+
+package main
+
+import (
+  "reflect"
+  "strings"
+  "testing"
+)
+
+func TestNegotiateCapabilities(t *testing.T) {
+  tests := []struct {
+    line string
+    version int
+    caps []string
+  }{
+    {"1", 1, nil},
+    {"2 codes tags", 2, []string{CapCodes, CapTags}},
+    {"9 codes", ProtocolVersion, []string{CapCodes}},
+    {"2 codes frobnicate tags", 2, []string{CapCodes, CapTags}},
+    {"1 codes tags", 1, nil},
+    {"2 msgid receipts", 2, []string{CapMsgId, CapReceipts}},
+    {"2 json", 2, []string{CapJSON}},
+  }
+  for _, test := range tests {
+    version, caps, err := NegotiateCapabilities(strings.Fields(test.line))
+    if err != nil {
+      t.Errorf("CHAT %s: %v", test.line, err)
+      continue
+    }
+    if version != test.version || !reflect.DeepEqual(caps, test.caps) {
+      t.Errorf("CHAT %s = %d %v, want %d %v", test.line, version, caps, test.version, test.caps)
+    }
+  }
+}
+
+func TestNegotiateCapabilitiesRefuses(t *testing.T) {
+  for _, line := range []string{"", "  ", "x", "0", "-1", "2 json binary", "2 receipts", "2 receipts codes"} {
+    if _, _, err := NegotiateCapabilities(strings.Fields(line)); ErrorCode(err) != CodeBadRequest {
+      t.Errorf("CHAT %q: got %v, want code %d", line, err, CodeBadRequest)
+    }
+  }
+}
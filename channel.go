@@ -0,0 +1,38 @@
+/* Gavin Langdon
+ * Network Programming
+ * Spring 2013
+ * Chat server
+ */
+
+// A channel is a list of accounts, so every connection of a user gets channel
+// messages, plus the accounts that run it
+
+package main
+
+import (
+  "container/list"
+)
+
+type Channel struct {
+  *List
+
+  // Usernames of the channel operators, who can edit and delete anyone's
+  // messages. Whoever makes the channel is its first operator
+  ops map[string] bool
+}
+
+func NewChannel(creator *ClientInfo) *Channel {
+  ch := &Channel{&List{list.New()}, map[string] bool{creator.username: true}}
+  ch.PushBack(creator)
+  return ch
+}
+
+func (ch *Channel) IsOp(username string) bool {
+  return ch.ops[username]
+}
+
+// Take a member out. Operators who leave stop being operators
+func (ch *Channel) Leave(e *list.Element) {
+  delete(ch.ops, e.Value.(*ClientInfo).username)
+  ch.Remove(e)
+}
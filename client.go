@@ -7,11 +7,15 @@
 package main
 
 import (
+  "bufio"
+  "io"
   "fmt"
   "net"
   "bytes"
   "regexp"
-  "errors"
+  "container/list"
+  "sync"
+  "unicode"
 )
 
 
@@ -20,26 +24,83 @@ type ClientId struct {
   password []byte
 }
 
+// How many mentions MENTIONS remembers
+const MaxMentions = 50
+
+// An account, which may have several clients connected at once
 type ClientInfo struct {
-  password []byte
+  username string
   loggedIn bool
-  client *Client
+  clients *List
+
+  // IDs of recent messages naming this user, oldest first
+  mentions []uint64
+  // Whether to hear about mentions in channels the user isn't in
+  allMentions bool
+
+  // See presence.go. An empty status is online
+  status string
+  statusText string
+  // Users already sent an away reply since the status last changed
+  awayReplied map[string] bool
+}
+
+func NewClientInfo(username string) *ClientInfo {
+  return &ClientInfo{username: username, clients: &List{list.New()}}
+}
+
+func (info *ClientInfo) AddMention(id uint64) {
+  if len(info.mentions) >= MaxMentions {
+    info.mentions = info.mentions[1:]
+  }
+  info.mentions = append(info.mentions, id)
+}
+
+// Whether any of the account's clients still has a live connection
+func (info *ClientInfo) Attached() bool {
+  for e := info.clients.Front(); e != nil; e = e.Next() {
+    if !e.Value.(*Client).Detached() {
+      return true
+    }
+  }
+  return false
 }
 
 var clientregex = regexp.MustCompile("^[[:alnum:]]+$")
 
 func NewClientId(username string, password []byte) (ClientId, error){
   if !clientregex.MatchString(username) {
-    return ClientId{}, errors.New("Invalid username chars provided")
+    return ClientId{}, ErrInvalidUsername
+  }
+  // Passwords get passed on to auth backends a line at a time
+  if bytes.IndexFunc(password, unicode.IsControl) >= 0 {
+    return ClientId{}, NewChatError(CodeBadRequest, "Password can't have control characters in it")
   }
 
   return ClientId{username, password}, nil
 }
 
 
+// Longest request line we'll read; longer lines are thrown away
+const MaxLineLength = 4096
+// JSON requests carry whole messages, escaped
+const MaxJSONLineLength = 8 * MaxMessageLength
+
+// Longest correlation tag a client can put in front of a request
+const MaxTagLength = 64
+
 type Client struct {
   net.Conn
 
+  // Buffers reads so that requests sent back to back are split into lines
+  reader *bufio.Reader
+  // How requests are framed and what we send back looks like
+  protocol Protocol
+  // What the last line read ended with, in case it was part of a message
+  lineEnding []byte
+  // Held while writing so messages and responses don't interleave
+  writeMu sync.Mutex
+
   responseCh chan *Response
   requestCh chan Requestable
 
@@ -48,9 +109,23 @@ type Client struct {
   loggedIn bool
   loginTries int
 
+  // Session this client resumes or is resumed from, nil until logged in
+  session *Session
+
+  // AUTH exchange waiting for its PROOF
+  scram *ScramExchange
+
+  // Capabilities turned on with CHAT
+  caps map[string] bool
+
   messagesSent int
 }
 
+// Whether the connection dropped and the session is waiting to be resumed
+func (cl *Client) Detached() bool {
+  return cl.session != nil && cl.session.detached
+}
+
 func (cl *Client) String() string {
   str := cl.RemoteAddr().String()
   if cl.loggedIn {
@@ -59,74 +134,150 @@ func (cl *Client) String() string {
   return str
 }
 
-func (cl *Client) HandleRequest(request []byte) (bool, error) {
-  if *VerboseMode {
-    fmt.Println("RCVD from", cl.String()+":", string(request))
+// The remote host without the port, for tracking clients across connections
+func (cl *Client) Host() string {
+  str := cl.RemoteAddr().String()
+  if host, _, err := net.SplitHostPort(str); err == nil {
+    return host
+  }
+  return str
+}
+
+// Read a line, without the line ending. TCP clients end requests with a
+// newline; UDP datagrams always end with one (see listenUDP)
+func (cl *Client) ReadLine() ([]byte, error) {
+  return cl.ReadLineLimit(MaxLineLength)
+}
+
+// Read a line of at most limit bytes. Longer lines are thrown away
+func (cl *Client) ReadLineLimit(limit int) ([]byte, error) {
+  var line []byte
+  for {
+    part, err := cl.reader.ReadSlice('\n')
+    if len(line) + len(part) <= limit {
+      // Copy out of the reader's buffer since messages hang on to their data
+      line = append(line, part...)
+    } else {
+      line = line[:0]
+      limit = -1
+    }
+    if err == bufio.ErrBufferFull {
+      continue
+    }
+    if err != nil {
+      return nil, err
+    }
+    break
+  }
+  if limit < 0 {
+    return nil, NewChatError(CodeTooLarge, "Line too long")
+  }
+
+  trimmed := bytes.TrimRight(line, "\r\n")
+  cl.lineEnding = append(cl.lineEnding[:0], line[len(trimmed):]...)
+  return bytes.TrimLeft(trimmed, "\r\n"), nil
+}
+
+// Read exactly n bytes, line endings and all
+func (cl *Client) ReadBytes(n int) ([]byte, error) {
+  buf := make([]byte, n)
+  _, err := io.ReadFull(cl.reader, buf)
+  return buf, err
+}
+
+// Split a leading #tag off a request. The tag is sent back on the response
+// so clients can send several requests without waiting for each reply
+func SplitTag(line []byte) (string, []byte, error) {
+  if len(line) == 0 || line[0] != '#' {
+    return "", line, nil
   }
 
-  temp := bytes.SplitN(request, []byte(" "), 2)
-  code := temp[0]
-  var data []byte
-  if len(temp) >= 2 {
-    data = temp[1]
+  spl := bytes.SplitN(line, []byte(" "), 2)
+  tag := string(spl[0])
+  if len(tag) < 2 || len(tag) > MaxTagLength {
+    return "", nil, NewChatError(CodeBadRequest, "Invalid tag")
   }
+  if len(spl) < 2 {
+    return tag, nil, ErrMissingArguments
+  }
+  return tag, spl[1], nil
+}
 
-  for request_str := range Requests {
+func (cl *Client) HandleRequest(rr *RawRequest) (bool, error) {
+  if *VerboseMode {
+    fmt.Println("RCVD from", cl.String()+":", rr.code, string(rr.args))
+  }
+
+  code := []byte(rr.code)
+  for request_str, rt := range Requests {
     if bytes.Compare(bytes.ToUpper(code), []byte(request_str)) == 0 {
-      rq := Requests[request_str]()
+      // Commands behind a capability don't exist for clients that didn't ask
+      if rt.capability != "" && !cl.Has(rt.capability) {
+        break
+      }
+
+      rq := rt.create()
       rq.SetClient(cl)
 
       if !rq.Validate() {
-        return false, errors.New("Not authorized to do this")
+        return false, ErrNotAuthorized
       }
 
-      err := rq.Create(data)
+      rq.SetBody(rr.body)
+      err := rq.Create(rr.args)
       if err != nil {
         return false, err
       }
       cl.requestCh <-rq
       response := <-cl.responseCh
+      for _, rs := range response.stream {
+        rs.tag = rr.tag
+        rs.WriteTo(cl)
+      }
+      response.tag = rr.tag
       response.WriteTo(cl)
 
       return response.Quit, nil
     }
   }
 
-  return false, errors.New("Invalid request code")
+  return false, ErrUnknownRequest
 }
 
 func (cl *Client) Close() error {
   // Defer connection closing
   defer cl.Conn.Close()
 
-  // Create a dummy quit request and shuttle it to the other goroutine
-  // so its data is cleaned up
-  var qr QuitRequest
-  qr.SetClient(cl)
-  cl.requestCh <-&qr
+  // Create a dummy drop request and shuttle it to the other goroutine
+  // so its data is cleaned up (or kept around for a resume)
+  var dr DropRequest
+  dr.SetClient(cl)
+  cl.requestCh <-&dr
   return nil
 }
 
 func (cl *Client) Serve() {
   defer cl.Close()
 
-  buf := make([]byte, 1024)
-
   for {
-    count, err := cl.Read(buf)
-    if err != nil {
+    rr, err := cl.protocol.ReadRequest(cl)
+    // Errors with a reply code go back to the client, anything else means
+    // the connection is gone
+    if _, ok := err.(interface{ Code() ReplyCode }); !ok && err != nil {
       fmt.Println(err)
       return
     }
-    if count <= 0 {
-      continue
-    }
 
-    request := bytes.Trim(buf[:count], "\r\n")
-    disconn, err := cl.HandleRequest(request)
+    disconn := false
+    if err == nil {
+      disconn, err = cl.HandleRequest(rr)
+    }
 
     if err != nil {
       response := NewErrorResponse(err)
+      if rr != nil {
+        response.tag = rr.tag
+      }
       response.WriteTo(cl)
 
       if _, ok := err.(*DisconnectError); ok {
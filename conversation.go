@@ -0,0 +1,123 @@
+/* Gavin Langdon
+ * Network Programming
+ * Spring 2013
+ * Chat server
+ */
+
+// A conversation is the direct messages between two users. The dispatcher
+// keeps track of how far each side has got through it
+
+package main
+
+import (
+  "time"
+)
+
+type Conversation struct {
+  users [2]string
+
+  // IDs of the messages that have been acknowledged but not read yet. ACKs
+  // can arrive in any order, so each message counts on its own
+  delivered map[uint64] bool
+  // Highest message ID each user has read, by username. Reading one message
+  // covers everything before it
+  read map[string] uint64
+
+  // When the latest message either way was sent, zero once they've all
+  // been deleted
+  last time.Time
+  // The messages each user got, oldest first, for counting unread ones
+  received map[string] []conversationMessage
+}
+
+type conversationMessage struct {
+  id uint64
+  time time.Time
+}
+
+func NewConversation(a string, b string) *Conversation {
+  return &Conversation{[2]string{a, b}, make(map[uint64] bool), make(map[string] uint64),
+    time.Time{}, make(map[string] []conversationMessage)}
+}
+
+// The user at the other end from this one
+func (c *Conversation) Other(username string) string {
+  if c.users[0] == username {
+    return c.users[1]
+  }
+  return c.users[0]
+}
+
+func (c *Conversation) Add(message *Message) {
+  c.last = message.time
+
+  received := c.received[message.target]
+  // Messages that have left history can't be READ anyway
+  if len(received) >= HistorySize {
+    delete(c.delivered, received[0].id)
+    received = received[1:]
+  }
+  c.received[message.target] = append(received, conversationMessage{message.id, message.time})
+}
+
+// Forget a deleted message, so it isn't unread or the latest any more
+func (c *Conversation) Remove(message *Message) {
+  received := c.received[message.target]
+  for i := range received {
+    if received[i].id == message.id {
+      c.received[message.target] = append(received[:i], received[i+1:]...)
+      break
+    }
+  }
+  delete(c.delivered, message.id)
+
+  c.last = time.Time{}
+  for _, received := range c.received {
+    if len(received) > 0 && received[len(received)-1].time.After(c.last) {
+      c.last = received[len(received)-1].time
+    }
+  }
+}
+
+// How many messages a user got after the last one they read
+func (c *Conversation) Unread(username string) int {
+  received := c.received[username]
+  n := 0
+  for i := len(received) - 1; i >= 0 && received[i].id > c.read[username]; i-- {
+    n++
+  }
+  return n
+}
+
+// Conversations are the same whichever side is asking
+func ConversationKey(a string, b string) string {
+  if a > b {
+    a, b = b, a
+  }
+  return a + " " + b
+}
+
+// Record that a user has received a message. False if we knew already
+func (c *Conversation) Deliver(username string, id uint64) bool {
+  if id <= c.read[username] || c.delivered[id] {
+    return false
+  }
+  c.delivered[id] = true
+  return true
+}
+
+// Record that a user has read everything up to id, which means they got it too
+func (c *Conversation) Read(username string, id uint64) bool {
+  if id <= c.read[username] {
+    return false
+  }
+  c.read[username] = id
+
+  // Read messages count as delivered from here on
+  for _, received := range c.received[username] {
+    if received.id <= id {
+      delete(c.delivered, received.id)
+    }
+  }
+  return true
+}
@@ -10,12 +10,14 @@
 package main
 
 import (
+  "bufio"
+  "fmt"
   "net"
   "container/list"
-  "errors"
-  // This is working but it requires a go get
-  //"code.google.com/p/go.crypto/bcrypt"
-  "bytes"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
 )
 
 func (d *Dispatcher) NewClient(conn net.Conn) *Client {
@@ -25,6 +27,14 @@ func (d *Dispatcher) NewClient(conn net.Conn) *Client {
   cl.loggedIn = false
   cl.loginTries = 0
   cl.Conn = conn
+  cl.reader = bufio.NewReaderSize(conn, MaxLineLength)
+  cl.protocol = TextProtocol{}
+
+  // Connections on the JSON port start out in JSON mode
+  if _, ok := conn.(*JSONConn); ok {
+    cl.caps = map[string] bool{CapJSON: true}
+    cl.protocol = JSONProtocol{}
+  }
 
   return &cl
 }
@@ -37,81 +47,267 @@ type Dispatcher struct {
   // Set of unique usernames mapping to password and login status
   clientSet map[string] *ClientInfo
 
-  // Map of channels (each channel is a list of clients)
-  channels map[string] *List
+  // Map of channels
+  channels map[string] *Channel
 
   // The channel the clients will send requests to
   requestCh chan Requestable
 
   // The channel the main thread will send new connections to
   connCh chan net.Conn
+
+  // Checks passwords
+  auth Authenticator
+
+  // Failed login tracking across connections
+  throttle *LoginThrottle
+
+  // Sessions by token, including ones waiting to be resumed
+  sessions map[string] *Session
+
+  // Recent messages, and where message IDs come from
+  history *History
+
+  // Direct message conversations by ConversationKey
+  conversations map[string] *Conversation
+
+  // Files sent with SENDFILE
+  files *FileStore
 }
 
-func NewDispatcher(connCh chan net.Conn) Dispatcher {
+func NewDispatcher(connCh chan net.Conn, auth Authenticator) Dispatcher {
   disp := Dispatcher{
     &List{list.New()},
     make(map[string] *ClientInfo),
-    make(map[string] *List),
+    make(map[string] *Channel),
     make(chan Requestable, 10),
-    connCh}
+    connCh,
+    auth,
+    NewLoginThrottle(),
+    make(map[string] *Session),
+    NewHistory(),
+    make(map[string] *Conversation),
+    NewFileStore()}
 
   return disp
 }
 
-func (d *Dispatcher) ClientLogin(client *Client, username string, password []byte) error {
-  // If user is already registered
-  if _, hit := d.clientSet[username]; hit {
-    // User logged in already
-    if d.clientSet[username].loggedIn {
-      return errors.New("This username is already in the channel")
+// Do slow work, like asking the auth backend, in its own goroutine so other
+// clients aren't kept waiting, then call finish back on the dispatcher with its
+// error. Whatever finish returns is the client's response
+func (d *Dispatcher) Later(client *Client, work func() error, finish func(error) (*Response, error)) {
+  go func() {
+    rq := &LaterRequest{err: work(), finish: finish}
+    rq.SetClient(client)
+    d.requestCh <- rq
+  }()
+}
+
+// Check a password in the background, then log the client in. done builds the
+// response from the outcome
+func (d *Dispatcher) ClientLogin(client *Client, username string, password []byte, done func(error) (*Response, error)) error {
+  if err := d.checkLogin(client, username); err != nil {
+    return err
+  }
+
+  d.Later(client, func() error {
+    return d.auth.Authenticate(username, password)
+  }, func(err error) (*Response, error) {
+    if err != nil {
+      return done(d.loginFailed(client, username, err))
+    }
+    // Things may have changed while we waited
+    if err := d.checkLogin(client, username); err != nil {
+      return done(err)
     }
+    return done(d.loginSucceeded(client, username))
+  })
+  return nil
+}
 
-    // Password incorrect
-    //if bcrypt.CompareHashAndPassword(d.clientSet[username].password, password) != nil {
-    if bytes.Compare(d.clientSet[username].password, password) != 0 {
-      client.loginTries++
-      if client.loginTries >= 3 {
-        err := NewDisconnectError("Max login tries. Bye")
-        return &err
-      }
+// Start a SCRAM login. The credentials are looked up, and maybe derived, in the
+// background, then done gets the server-first-message for the client
+func (d *Dispatcher) ClientScramStart(client *Client, exchange *ScramExchange, done func(string, error) (*Response, error)) error {
+  if err := d.checkLogin(client, exchange.username); err != nil {
+    return err
+  }
 
-      return errors.New("Invalid password specified for user")
+  source, ok := d.auth.(ScramCredentialSource)
+  if !ok {
+    return NewChatError(CodeAuthDisabled, "Authentication backend does not support " + ScramMechanism)
+  }
+
+  var challenge string
+  d.Later(client, func() error {
+    creds, err := source.ScramCredentials(exchange.username)
+    if err != nil {
+      return err
+    }
+    challenge, err = exchange.Challenge(creds)
+    return err
+  }, func(err error) (*Response, error) {
+    if err != nil {
+      return done("", err)
     }
+    client.scram = exchange
+    return done(challenge, nil)
+  })
+  return nil
+}
+
+// Finish a SCRAM login, returning the server signature for the client
+func (d *Dispatcher) ClientScramFinish(client *Client, clientFinal string) (string, error) {
+  exchange := client.scram
+  if exchange == nil {
+    return "", NewChatError(CodeAuthFailed, "No authentication in progress")
+  }
+  // One proof per challenge
+  client.scram = nil
 
+  // Things may have changed since the challenge
+  if err := d.checkLogin(client, exchange.username); err != nil {
+    return "", err
   }
 
-  /*crypt, err := bcrypt.GenerateFromPassword(password, 0)
+  signature, err := exchange.Verify(clientFinal)
   if err != nil {
+    return "", d.loginFailed(client, exchange.username, err)
+  }
+
+  return signature, d.loginSucceeded(client, exchange.username)
+}
+
+// Whether a username may log in at all right now
+func (d *Dispatcher) checkLogin(client *Client, username string) error {
+  // Refuse outright while the username or host is locked out
+  if err := d.throttle.Check(username, client.Host()); err != nil {
     return err
-  }*/
+  }
+
+  // User logged in already, unless we allow more than one connection
+  if info, hit := d.clientSet[username]; hit && info.Attached() && !*MultiLogin {
+    return ErrNameInUse
+  }
+  return nil
+}
+
+func (d *Dispatcher) loginFailed(client *Client, username string, err error) error {
+  // Only a wrong password counts against the user
+  if err != ErrBadPassword {
+    return err
+  }
+  d.throttle.Fail(username, client.Host())
+
+  client.loginTries++
+  if client.loginTries >= 3 {
+    err := NewDisconnectError(CodeLockedOut, "Max login tries. Bye")
+    return &err
+  }
+
+  return err
+}
+
+func (d *Dispatcher) loginSucceeded(client *Client, username string) error {
+  d.throttle.Succeed(username, client.Host())
+
+  info, hit := d.clientSet[username]
+  if !hit {
+    info = NewClientInfo(username)
+    d.clientSet[username] = info
+  } else if !*MultiLogin {
+    // A dropped session waiting to be resumed is replaced by the new login
+    for e := info.clients.Front(); e != nil; e = info.clients.Front() {
+      d.ClientQuit(e.Value.(*Client))
+    }
+  }
+
+  // Only clients that can resume get a session to resume
+  if client.Has(CapResume) {
+    token, err := NewSessionToken()
+    if err != nil {
+      return err
+    }
+    client.session = &Session{token: token, client: client}
+    d.sessions[token] = client.session
+  }
 
   client.username = username
 
   client.loggedIn = true
   client.loginTries = 0
 
-  d.clientSet[username] = &ClientInfo{password, true, client}
+  info.loggedIn = true
+  info.clients.PushBack(client)
 
   return nil
 }
 
-// Fetch a client by username
-func (d *Dispatcher) GetClient(username string) (*Client, error) {
-  // Find client
+// Reattach a new connection to the session with the given token, taking over
+// its username, channels and any messages buffered while it was away
+func (d *Dispatcher) ClientResume(client *Client, token string) error {
+  session := d.sessions[token]
+  if session == nil {
+    return ErrBadSession
+  }
+  old := session.client
+
+  // If the old connection is somehow still up, the new one wins
+  if !session.detached {
+    if e := d.clients.Find(old); e != nil {
+      d.clients.Remove(e)
+    }
+    old.Conn.Close()
+  }
+
+  // Swap the new client in for the old one. Channels are joined by the
+  // account, so they carry over as they are
+  if e := d.clientSet[old.username].clients.Find(old); e != nil {
+    e.Value = client
+  }
+
+  client.username = old.username
+  client.loggedIn = true
+  client.messagesSent = old.messagesSent
+  old.session = nil
+
+  // Hand out a fresh token so the old one can't be replayed
+  newToken, err := NewSessionToken()
+  if err != nil {
+    return err
+  }
+  delete(d.sessions, token)
+  session.token = newToken
+  session.client = client
+  session.detached = false
+  d.sessions[newToken] = session
+  client.session = session
+
+  buffer := session.buffer
+  session.buffer = nil
+  for _, message := range buffer {
+    d.Deliver(message, client)
+  }
+
+  return nil
+}
+
+// Fetch a logged in account by username
+func (d *Dispatcher) GetAccount(username string) (*ClientInfo, error) {
+  // Find account
   if info, ok := d.clientSet[username]; ok {
-    // Ensure client is logged in
-    if info.client != nil {
-      return info.client, nil
+    // Ensure it has at least one client logged in
+    if info.loggedIn {
+      return info, nil
     }
   }
-  return nil, errors.New("Client not found")
+  return nil, ErrNoSuchUser
 }
 
-func (d *Dispatcher) GetChannel(channel string) (*List, error) {
+func (d *Dispatcher) GetChannel(channel string) (*Channel, error) {
   if channelList := d.channels[channel]; channelList != nil {
     return channelList, nil
   }
-  return nil, errors.New("Channel does not exist")
+  return nil, ErrNoSuchChannel
 }
 
 func (d *Dispatcher) ClientJoin(client *Client, channel string) error {
@@ -119,21 +315,33 @@ func (d *Dispatcher) ClientJoin(client *Client, channel string) error {
   channelList, _ := d.GetChannel(channel)
 
   // If it doesn't exist, make a new one
+  info := d.clientSet[client.username]
   if channelList == nil {
-    channelList = &List{list.New()}
+    channelList = NewChannel(info)
     d.channels[channel] = channelList
   }
   // If the client is not in the channel, add them
-  if e := channelList.Find(client); e == nil {
-    channelList.PushBack(client)
+  if e := channelList.Find(info); e == nil {
+    channelList.PushBack(info)
+    d.Announce(channel, info.username + " joined")
+
+    // Members may last have heard they went offline
+    audience := make(map[*ClientInfo] bool)
+    for e := channelList.Front(); e != nil; e = e.Next() {
+      audience[e.Value.(*ClientInfo)] = true
+    }
+    d.PresenceTo(info, info.StatusLine(), audience)
   }
 
   return nil
 }
 
-func (d *Dispatcher) ClientPartAll(client *Client) {
-  for key, _ := range d.channels {
-    d.ClientPart(client, key)
+func (d *Dispatcher) ClientPartAll(info *ClientInfo) {
+  for channel, channelList := range d.channels {
+    if e := channelList.Find(info); e != nil {
+      channelList.Leave(e)
+      d.Announce(channel, info.username + " quit")
+    }
   }
 }
 
@@ -145,16 +353,58 @@ func (d *Dispatcher) ClientPart(client *Client, channel string) error {
   }
 
   // If user is in channel, remove
-  if e := channelList.Find(client); e != nil {
-    channelList.Remove(e)
+  if e := channelList.Find(d.clientSet[client.username]); e != nil {
+    channelList.Leave(e)
+    d.Announce(channel, client.username + " left")
     return nil
   }
 
-  return errors.New("You are not in this channel")
+  return ErrNotInChannel
+}
+
+// Tell a channel's members who understand system messages what's going on.
+// These aren't kept in history
+func (d *Dispatcher) Announce(channel string, text string) {
+  message := NewSystemMessage("@" + channel, text)
+  message.time = time.Now()
+  for e := d.channels[channel].Front(); e != nil; e = e.Next() {
+    info := e.Value.(*ClientInfo)
+    for c := info.clients.Front(); c != nil; c = c.Next() {
+      if client := c.Value.(*Client); client.Has(CapKinds) {
+        d.Deliver(message, client)
+      }
+    }
+  }
 }
 
 // Send a message
 func (d *Dispatcher) SayTo(message *Message) error {
+  return d.sayTo(message, make(map[*ClientInfo] bool), make(map[string] bool))
+}
+
+// Send a message to several targets. Each target gets a copy of its own, with
+// its own ID, but nobody gets more than one, or is mentioned more than once.
+// Returns what happened for each
+func (d *Dispatcher) SayToAll(message *Message, targets []string) []error {
+  seen := make(map[*ClientInfo] bool)
+  mentioned := make(map[string] bool)
+  errs := make([]error, len(targets))
+  for i, target := range targets {
+    each := *message
+    each.target = target
+    errs[i] = d.sayTo(&each, seen, mentioned)
+  }
+  return errs
+}
+
+// Send a message to everyone it's for who hasn't been seen yet
+func (d *Dispatcher) sayTo(message *Message, seen map[*ClientInfo] bool, mentioned map[string] bool) error {
+  if message.parent != 0 {
+    if err := d.checkParent(message); err != nil {
+      return err
+    }
+  }
+
   // Messages starting with @ will be to channels
   if message.target[0] == '@' {
     channelList, err := d.GetChannel(message.target[1:])
@@ -162,49 +412,622 @@ func (d *Dispatcher) SayTo(message *Message) error {
       return err
     }
 
+    d.history.Add(message)
     for e := channelList.Front(); e != nil; e = e.Next() {
-      message.WriteTo(e.Value.(*Client))
+      info := e.Value.(*ClientInfo)
+      if !seen[info] {
+        seen[info] = true
+        message.recipients = append(message.recipients, info.username)
+        d.DeliverAccount(message, info)
+      }
     }
+    d.Mention(message, channelList, mentioned)
     return nil
   }
 
-  // Otherwise send a single message to a client
-  client, err := d.GetClient(message.target)
+  // Otherwise send a single message to every connection of a user
+  info, err := d.GetAccount(message.target)
   if err != nil {
     return err
   }
 
-  message.WriteTo(client)
+  // Someone who already got it through a channel doesn't get a copy, so
+  // there's nothing to remember either
+  if !seen[info] {
+    seen[info] = true
+    d.history.Add(message)
+    d.Conversation(message.from, message.target).Add(message)
+    message.recipients = []string{info.username}
+    d.DeliverAccount(message, info)
+    d.AwayReply(message, info)
+  }
 
   return nil
 }
 
-func (d *Dispatcher) ClientQuit(client *Client) {
-  // leave all channels
-  d.ClientPartAll(client)
+// Answer a direct message to an away user for them, once. Notices are never
+// answered, which also stops two away users answering each other forever
+func (d *Dispatcher) AwayReply(message *Message, info *ClientInfo) {
+  if message.event != "" && message.event != KindAction {
+    return
+  }
+  if message.from == info.username || !info.ShouldAwayReply(message.from) {
+    return
+  }
+
+  text := info.statusText
+  if text == "" {
+    text = DefaultAwayReply
+  }
+  // Straight back to the sender, without going in history or the
+  // conversation like a message the user sent themselves would
+  reply := NewTextMessage(info.username, message.from, []byte(text))
+  reply.event = KindNotice
+  reply.time = time.Now()
+  if sender := d.clientSet[message.from]; sender != nil {
+    d.DeliverAccount(reply, sender)
+  }
+}
+
+// Change a user's status and tell everyone who shares a channel with them
+func (d *Dispatcher) ClientStatus(client *Client, status string, text string) {
+  info := d.clientSet[client.username]
+  if info.Status() == status && info.statusText == text {
+    return
+  }
+  info.SetStatus(status, text)
+  d.Presence(info, info.StatusLine())
+}
+
+// Send a PRESENCE event about a user to its own clients and everyone who
+// shares a channel with it
+func (d *Dispatcher) Presence(info *ClientInfo, line string) {
+  audience := map[*ClientInfo] bool{info: true}
+  for _, channelList := range d.channels {
+    if channelList.Find(info) == nil {
+      continue
+    }
+    for e := channelList.Front(); e != nil; e = e.Next() {
+      audience[e.Value.(*ClientInfo)] = true
+    }
+  }
+  d.PresenceTo(info, line, audience)
+}
+
+// Send a PRESENCE event about a user to the accounts given
+func (d *Dispatcher) PresenceTo(info *ClientInfo, line string, audience map[*ClientInfo] bool) {
+  event := NewTextMessage(info.username, info.username, []byte(line))
+  event.event = "PRESENCE"
+  event.time = time.Now()
+
+  for member := range audience {
+    for e := member.clients.Front(); e != nil; e = e.Next() {
+      if client := e.Value.(*Client); client.Has(CapPresence) {
+        d.Deliver(event, client)
+      }
+    }
+  }
+}
+
+// Send a client the last count messages from a channel it's in
+func (d *Dispatcher) ClientHistory(client *Client, channel string, count int) error {
+  channelList, err := d.GetChannel(channel)
+  if err != nil {
+    return err
+  }
+  if channelList.Find(d.clientSet[client.username]) == nil {
+    return ErrNotInChannel
+  }
+
+  for _, message := range d.history.Target("@" + channel, count) {
+    d.Deliver(message, client)
+  }
+  return nil
+}
+
+// Let the users a channel message names know about it. Users outside the
+// channel only hear about it if they've asked to
+func (d *Dispatcher) Mention(message *Message, channelList *Channel, mentioned map[string] bool) {
+  if message.event == KindSystem {
+    return
+  }
+
+  for _, username := range message.Mentions() {
+    info := d.clientSet[username]
+    if info == nil || username == message.from || mentioned[username] {
+      continue
+    }
+    if !info.allMentions && channelList.Find(info) == nil {
+      continue
+    }
+    mentioned[username] = true
+
+    info.AddMention(message.id)
+    d.DeliverMention(message, info)
+  }
+}
+
+func (d *Dispatcher) DeliverMention(message *Message, info *ClientInfo) {
+  mention := *message
+  mention.event = "MENTION"
+  for e := info.clients.Front(); e != nil; e = e.Next() {
+    if client := e.Value.(*Client); client.Has(CapMentions) {
+      d.Deliver(&mention, client)
+    }
+  }
+}
+
+// Send a client the recent messages that named it, that it can still see
+func (d *Dispatcher) ClientMentions(client *Client) {
+  info := d.clientSet[client.username]
+  for _, id := range info.mentions {
+    message := d.history.Get(id)
+    if message == nil {
+      continue
+    }
+    if !info.allMentions && !d.CanSee(client.username, message) {
+      continue
+    }
+
+    mention := *message
+    mention.event = "MENTION"
+    d.Deliver(&mention, client)
+  }
+}
+
+// React to a message the client can see. Everyone who can see it hears about it
+func (d *Dispatcher) ClientReact(client *Client, id uint64, emoji string) error {
+  message := d.history.Get(id)
+  if message == nil || !d.CanSee(client.username, message) {
+    return ErrNoSuchMessage
+  }
+  if message.reactions[emoji] == nil && len(message.reactions) >= MaxReactions {
+    return NewChatError(CodeTooLarge, "Too many different reactions")
+  }
+  if !message.React(client.username, emoji) {
+    return nil
+  }
+
+  event := NewTextMessage(client.username, message.target, []byte(emoji))
+  event.event = "REACT"
+  event.id, event.time = message.id, time.Now()
+  d.Broadcast(event, message.from, message.target, CapMsgId)
+  return nil
+}
+
+// Send an event to everyone who can see what goes from a user to a target
+// (the channel, or both ends of a direct message), if they have the capability
+func (d *Dispatcher) Broadcast(event *Message, from string, target string, capability string) {
+  var audience []*ClientInfo
+  if target[0] == '@' {
+    for e := d.channels[target[1:]].Front(); e != nil; e = e.Next() {
+      audience = append(audience, e.Value.(*ClientInfo))
+    }
+  } else {
+    audience = append(audience, d.clientSet[from])
+    if target != from {
+      audience = append(audience, d.clientSet[target])
+    }
+  }
 
+  for _, info := range audience {
+    if info == nil {
+      continue
+    }
+    for e := info.clients.Front(); e != nil; e = e.Next() {
+      if client := e.Value.(*Client); client.Has(capability) {
+        d.Deliver(event, client)
+      }
+    }
+  }
+}
+
+// A reply has to go where the message it answers went. A reply to a reply
+// goes in the same thread
+func (d *Dispatcher) checkParent(message *Message) error {
+  parent := d.history.Get(message.parent)
+  if parent == nil {
+    return ErrNoSuchMessage
+  }
+
+  if message.target[0] == '@' || parent.target[0] == '@' {
+    if message.target != parent.target {
+      return ErrWrongThread
+    }
+  } else if ConversationKey(message.from, message.target) != ConversationKey(parent.from, parent.target) {
+    return ErrWrongThread
+  }
+
+  if parent.parent != 0 {
+    message.parent = parent.parent
+  }
+  return nil
+}
+
+// Whether a user can see a message: they're in its channel, or it's to or from them
+func (d *Dispatcher) CanSee(username string, message *Message) bool {
+  return d.canSeeTarget(username, message.from, message.target)
+}
+
+func (d *Dispatcher) canSeeTarget(username string, from string, target string) bool {
+  if target[0] == '@' {
+    channelList := d.channels[target[1:]]
+    return channelList != nil && channelList.Find(d.clientSet[username]) != nil
+  }
+  return from == username || target == username
+}
+
+// Send a client a page of the messages it got or sent with all the words in
+// the query, newest first. Scope is a channel, a user to search the direct
+// messages with, or "" for everything. Returns the ID to search before for the
+// next page, or 0 if that's all
+func (d *Dispatcher) ClientSearch(client *Client, scope string, before uint64, query []string) (uint64, error) {
+  if strings.HasPrefix(scope, "@") {
+    if _, err := d.GetChannel(scope[1:]); err != nil {
+      return 0, err
+    }
+  } else if scope != "" && d.clientSet[scope] == nil {
+    return 0, ErrNoSuchUser
+  }
+
+  found, more := d.history.Search(query, before, func(message *Message) bool {
+    if !message.SentTo(client.username) {
+      return false
+    }
+    switch {
+    case scope == "":
+      return true
+    case scope[0] == '@':
+      return message.target == scope
+    }
+    return message.target[0] != '@' &&
+      ConversationKey(message.from, message.target) == ConversationKey(client.username, scope)
+  })
+
+  for _, message := range found {
+    d.Deliver(message, client)
+  }
+  if more {
+    return found[len(found) - 1].id, nil
+  }
+  return 0, nil
+}
+
+// Send a client a message and all the replies to it
+func (d *Dispatcher) ClientThread(client *Client, id uint64) error {
+  parent := d.history.Get(id)
+  if parent == nil || !d.CanSee(client.username, parent) {
+    return ErrNoSuchMessage
+  }
+  // Asking for a reply's thread gets the whole thread
+  if parent.parent != 0 {
+    if parent = d.history.Get(parent.parent); parent == nil {
+      return ErrNoSuchMessage
+    }
+  }
+
+  d.Deliver(parent, client)
+  for _, message := range d.history.Replies(parent.id) {
+    d.Deliver(message, client)
+  }
+  return nil
+}
+
+// Find a message the client may change: its own, or any in a channel it runs
+func (d *Dispatcher) ownMessage(client *Client, id uint64) (*Message, error) {
+  message := d.history.Get(id)
+  if message == nil {
+    return nil, ErrNoSuchMessage
+  }
+  if message.from == client.username {
+    return message, nil
+  }
+  if message.target[0] == '@' {
+    if channel := d.channels[message.target[1:]]; channel != nil && channel.IsOp(client.username) {
+      return message, nil
+    }
+  }
+  return nil, ErrNotAllowed
+}
+
+func (d *Dispatcher) ClientEdit(client *Client, id uint64, text []byte) error {
+  message, err := d.ownMessage(client, id)
+  if err != nil {
+    return err
+  }
+
+  d.history.Edit(message, text)
+
+  event := NewTextMessage(message.from, message.target, text)
+  event.event = "EDIT"
+  event.id, event.time, event.editor = message.id, message.edited, client.username
+  d.Notify(message, event)
+  return nil
+}
+
+func (d *Dispatcher) ClientDelete(client *Client, id uint64) error {
+  message, err := d.ownMessage(client, id)
+  if err != nil {
+    return err
+  }
+
+  d.history.Remove(id)
+  if message.target[0] != '@' {
+    if conversation := d.conversations[ConversationKey(message.from, message.target)]; conversation != nil {
+      conversation.Remove(message)
+    }
+  }
+
+  event := NewTextMessage(message.from, message.target, nil)
+  event.event = "DELETE"
+  event.id, event.time, event.editor = message.id, time.Now(), client.username
+  d.Notify(message, event)
+  return nil
+}
+
+// Tell the sender and everyone who got a message about a change to it. Only
+// clients that know message IDs can make sense of it. Sessions still holding
+// the message haven't seen it yet, so they get the edited text with it, or
+// nothing if it's been deleted
+func (d *Dispatcher) Notify(message *Message, event *Message) {
+  seen := make(map[string] bool)
+  for _, username := range append([]string{message.from}, message.recipients...) {
+    info := d.clientSet[username]
+    if seen[username] || info == nil {
+      continue
+    }
+    seen[username] = true
+
+    for e := info.clients.Front(); e != nil; e = e.Next() {
+      client := e.Value.(*Client)
+      if client.Detached() && client.session.Buffered(message) {
+        if event.event == "DELETE" {
+          client.session.Unbuffer(message)
+        }
+        continue
+      }
+      if client.Has(CapMsgId) {
+        d.Deliver(event, client)
+      }
+    }
+  }
+}
+
+// Find the conversation a direct message to the client is part of
+func (d *Dispatcher) receivedMessage(client *Client, id uint64) (*Message, *Conversation, error) {
+  message := d.history.Get(id)
+  if message == nil || message.target != client.username {
+    return nil, nil, ErrNoSuchMessage
+  }
+
+  return message, d.Conversation(message.from, message.target), nil
+}
+
+// The conversation between two users, started if need be
+func (d *Dispatcher) Conversation(a string, b string) *Conversation {
+  key := ConversationKey(a, b)
+  conversation := d.conversations[key]
+  if conversation == nil {
+    conversation = NewConversation(a, b)
+    d.conversations[key] = conversation
+  }
+  return conversation
+}
+
+// A user's conversations, latest first. Ones with nothing left in them don't
+// count
+func (d *Dispatcher) ClientConversations(client *Client) []*Conversation {
+  var found []*Conversation
+  for _, conversation := range d.conversations {
+    if conversation.last.IsZero() {
+      continue
+    }
+    if conversation.users[0] == client.username || conversation.users[1] == client.username {
+      found = append(found, conversation)
+    }
+  }
+  sort.Slice(found, func(i, j int) bool { return found[i].last.After(found[j].last) })
+  return found
+}
+
+// Send a client the last count direct messages between it and another user
+func (d *Dispatcher) ClientConversationHistory(client *Client, username string, count int) error {
+  if d.clientSet[username] == nil {
+    return ErrNoSuchUser
+  }
+
+  for _, message := range d.history.Conversation(client.username, username, count) {
+    d.Deliver(message, client)
+  }
+  return nil
+}
+
+// The client got a direct message
+func (d *Dispatcher) ClientAck(client *Client, id uint64) error {
+  message, conversation, err := d.receivedMessage(client, id)
+  if err != nil {
+    return err
+  }
+
+  if conversation.Deliver(client.username, id) {
+    d.Receipt("DELIVERED", client.username, message)
+  }
+  return nil
+}
+
+// The client read a direct message and everything before it from the same user
+func (d *Dispatcher) ClientRead(client *Client, id uint64) error {
+  message, conversation, err := d.receivedMessage(client, id)
+  if err != nil {
+    return err
+  }
+
+  if conversation.Read(client.username, id) {
+    d.Receipt("READ", client.username, message)
+  }
+  return nil
+}
+
+// Let the sender of a message know how far its recipient has got
+func (d *Dispatcher) Receipt(event string, username string, message *Message) {
+  info := d.clientSet[message.from]
+  if info == nil {
+    return
+  }
+
+  receipt := NewTextMessage(username, message.from, nil)
+  receipt.event = event
+  receipt.id, receipt.time = message.id, time.Now()
+  for e := info.clients.Front(); e != nil; e = e.Next() {
+    if client := e.Value.(*Client); client.Has(CapReceipts) {
+      d.Deliver(receipt, client)
+    }
+  }
+}
+
+func (d *Dispatcher) DeliverAccount(message *Message, info *ClientInfo) {
+  for e := info.clients.Front(); e != nil; e = e.Next() {
+    d.Deliver(message, e.Value.(*Client))
+  }
+}
+
+// Write a message to a client, or buffer it if the client's connection has
+// dropped and it may still resume
+func (d *Dispatcher) Deliver(message *Message, client *Client) {
+  if client.Detached() {
+    client.session.Buffer(message)
+    return
+  }
+  message.WriteTo(client)
+}
+
+func (d *Dispatcher) ClientQuit(client *Client) {
   // Remove from client list
   if e := d.clients.Find(client); e != nil {
     d.clients.Remove(e)
   }
 
+  if client.session != nil {
+    delete(d.sessions, client.session.token)
+    client.session = nil
+  }
+
   if client.loggedIn {
-    // Set state in saved client list
-    cs := d.clientSet[client.username]
-    cs.loggedIn = false
     // Remove reference to this client instance
-    cs.client = nil
+    cs := d.clientSet[client.username]
+    if e := cs.clients.Find(client); e != nil {
+      cs.clients.Remove(e)
+
+      // Last connection for this account, leave all channels. Whatever
+      // the status was, it's gone now
+      if cs.clients.Len() == 0 {
+        cs.loggedIn = false
+        d.Presence(cs, StatusOffline)
+        cs.SetStatus("", "")
+        d.ClientPartAll(cs)
+      }
+    }
+  }
+}
+
+// The client's connection went away without a QUIT. Logged in clients are
+// kept for a grace period so they can resume
+func (d *Dispatcher) ClientDrop(client *Client) {
+  e := d.clients.Find(client)
+  // Already quit or taken over by a resume
+  if e == nil {
+    return
+  }
+
+  if client.session == nil {
+    d.ClientQuit(client)
+    return
+  }
+
+  d.clients.Remove(e)
+  client.session.Detach()
+  fmt.Println("Session for", client.username, "detached, waiting", SessionGracePeriod, "for resume")
+}
+
+// Start a file upload to a user or channel
+func (d *Dispatcher) ClientSendFile(client *Client, target string, name string, size int) (*File, error) {
+  if target[0] == '@' {
+    if _, err := d.GetChannel(target[1:]); err != nil {
+      return nil, err
+    }
+  } else if _, err := d.GetAccount(target); err != nil {
+    return nil, err
+  }
+
+  return d.files.Start(client.username, target, name, size)
+}
+
+// Add the next piece of a file the client is uploading, returning how much is
+// there now. Pieces we already have are ignored, so they can be sent again
+// if the client isn't sure they arrived
+func (d *Dispatcher) ClientFileData(client *Client, id uint64, offset int, data []byte) (int, error) {
+  file := d.files.Get(id)
+  if file == nil || file.from != client.username {
+    return 0, ErrNoSuchFile
+  }
+  if offset + len(data) <= len(file.data) {
+    return len(file.data), nil
+  }
+  if offset != len(file.data) {
+    return 0, NewChatError(CodeBadRequest, "Expected offset " + strconv.Itoa(len(file.data)))
+  }
+  if offset + len(data) > file.size {
+    return 0, NewChatError(CodeTooLarge, "More data than the file's size")
+  }
+
+  if err := d.files.Append(file, data); err != nil {
+    return 0, err
+  }
+  if file.Complete() {
+    // Tell everyone it's for that it's ready
+    event := NewTextMessage(file.from, file.target,
+      []byte(strconv.FormatUint(file.id, 10) + " " + strconv.Itoa(file.size) + " " + file.name))
+    event.event = "FILE"
+    event.time = time.Now()
+    d.Broadcast(event, file.from, file.target, CapFiles)
+  }
+  return len(file.data), nil
+}
+
+// A finished file the client can see
+func (d *Dispatcher) ClientGetFile(client *Client, id uint64) (*File, error) {
+  file := d.files.Get(id)
+  if file == nil || !file.Complete() || !d.canSeeTarget(client.username, file.from, file.target) {
+    return nil, ErrNoSuchFile
+  }
+  return file, nil
+}
+
+// Quit any dropped sessions whose grace period is over
+func (d *Dispatcher) ExpireSessions() {
+  for _, session := range d.sessions {
+    if session.Expired() {
+      fmt.Println("Session for", session.client.username, "expired")
+      d.ClientQuit(session.client)
+    }
   }
 }
 
 
 // Dispatch loop adds new connections and fetches requests from existing
 // connections
-func Dispatch(connCh chan net.Conn) {
-  dispatcher := NewDispatcher(connCh)
+func Dispatch(connCh chan net.Conn, auth Authenticator) {
+  dispatcher := NewDispatcher(connCh, auth)
+  ticker := time.Tick(10 * time.Second)
 
   for {
     select {
+      // Periodic housekeeping
+      case <-ticker:
+        dispatcher.throttle.Prune()
+        dispatcher.ExpireSessions()
+        dispatcher.files.Expire()
+
       // New connection
       case conn := <-dispatcher.connCh:
         cl := dispatcher.NewClient(conn)
@@ -215,6 +1038,10 @@ func Dispatch(connCh chan net.Conn) {
       // Existing connection request
       case request := <-dispatcher.requestCh:
         response, err := request.Handle(&dispatcher)
+        // Nothing yet means the response comes later, from a LaterRequest
+        if response == nil && err == nil {
+          break
+        }
         if err != nil {
           if response == nil {
             er := NewErrorResponse(err)
@@ -6,14 +6,100 @@
 
 package main
 
-type DisconnectError struct {
+// Every response carries one of these so clients don't have to match on error
+// text. The catalog is in README.txt--codes never change meaning once added
+type ReplyCode int
+
+const (
+  CodeOk ReplyCode = 200
+  CodeClosing ReplyCode = 221
+
+  CodeContinue ReplyCode = 300
+
+  CodeBadRequest ReplyCode = 400
+  CodeUnknownCommand ReplyCode = 401
+  CodeNotLoggedIn ReplyCode = 402
+  CodeAlreadyLoggedIn ReplyCode = 403
+  CodeNoSuchUser ReplyCode = 404
+  CodeNoSuchChannel ReplyCode = 405
+  CodeNotInChannel ReplyCode = 406
+  CodeInvalidName ReplyCode = 407
+  CodeTimeout ReplyCode = 408
+  CodeNoSuchMessage ReplyCode = 409
+  CodeNotAllowed ReplyCode = 410
+  CodeNoSuchFile ReplyCode = 411
+  CodeTooLarge ReplyCode = 413
+  CodeLengthMismatch ReplyCode = 414
+  CodeAborted ReplyCode = 415
+
+  CodeBadPassword ReplyCode = 430
+  CodeLockedOut ReplyCode = 431
+  CodeNameInUse ReplyCode = 432
+  CodeBadSession ReplyCode = 433
+  CodeAuthDisabled ReplyCode = 434
+  CodeAuthFailed ReplyCode = 435
+
+  CodeServerError ReplyCode = 500
+  CodeAuthUnavailable ReplyCode = 503
+)
+
+// An error that knows which reply code to send
+type ChatError struct {
+  code ReplyCode
   err string
 }
 
-func NewDisconnectError(err string) DisconnectError {
-  return DisconnectError{err}
+func NewChatError(code ReplyCode, err string) *ChatError {
+  return &ChatError{code, err}
 }
 
-func (e *DisconnectError) Error() string {
+func (e *ChatError) Error() string {
   return e.err
 }
+
+func (e *ChatError) Code() ReplyCode {
+  return e.code
+}
+
+// An error after which the client gets disconnected
+type DisconnectError struct {
+  ChatError
+}
+
+func NewDisconnectError(code ReplyCode, err string) DisconnectError {
+  return DisconnectError{ChatError{code, err}}
+}
+
+// The reply code for any error, errors we didn't make ourselves are the server's fault
+func ErrorCode(err error) ReplyCode {
+  if coded, ok := err.(interface{ Code() ReplyCode }); ok {
+    return coded.Code()
+  }
+  return CodeServerError
+}
+
+// Errors that don't change with their arguments
+var (
+  ErrMissingArguments = NewChatError(CodeBadRequest, "Missing argument(s)")
+  ErrMalformedPacket = NewChatError(CodeBadRequest, "Malformed packet")
+  ErrUnknownRequest = NewChatError(CodeUnknownCommand, "Invalid request code")
+  ErrNotAuthorized = NewChatError(CodeNotLoggedIn, "Not authorized to do this")
+  ErrAlreadyLoggedIn = NewChatError(CodeAlreadyLoggedIn, "You are already logged in")
+  ErrNoSuchUser = NewChatError(CodeNoSuchUser, "Client not found")
+  ErrNoSuchChannel = NewChatError(CodeNoSuchChannel, "Channel does not exist")
+  ErrNotInChannel = NewChatError(CodeNotInChannel, "You are not in this channel")
+  ErrInvalidUsername = NewChatError(CodeInvalidName, "Invalid username chars provided")
+  ErrInvalidChannel = NewChatError(CodeInvalidName, "Invalid characters for channel name")
+  ErrNoSuchMessage = NewChatError(CodeNoSuchMessage, "Message not found")
+  ErrNoSuchFile = NewChatError(CodeNoSuchFile, "File not found")
+  ErrWrongThread = NewChatError(CodeBadRequest, "Replies go to the same place as the message they answer")
+  ErrNotAllowed = NewChatError(CodeNotAllowed, "Only the author or a channel operator can do that")
+  ErrMessageTimeout = NewChatError(CodeTimeout, "Timed out waiting for the rest of the message")
+  ErrMessageTooLarge = NewChatError(CodeTooLarge, "Message too large")
+  ErrMessageAborted = NewChatError(CodeAborted, "Message aborted")
+
+  ErrBadPassword = NewChatError(CodeBadPassword, "Invalid password specified for user")
+  ErrNameInUse = NewChatError(CodeNameInUse, "This username is already in the channel")
+  ErrBadSession = NewChatError(CodeBadSession, "Invalid or expired session token")
+  ErrAuthUnavailable = NewChatError(CodeAuthUnavailable, "Authentication backend unavailable")
+)
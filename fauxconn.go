@@ -12,6 +12,7 @@ package main
 
 import (
   "net"
+  "os"
   "time"
 )
 
@@ -22,11 +23,24 @@ type FauxConn struct {
   mainConn net.PacketConn
 
   closeCh chan string
+
+  readDeadline time.Time
 }
 
 // Read from the channel buffer
 func (c *FauxConn) Read(b []byte) (int, error) {
-  return copy(b, <-c.inCh), nil
+  if c.readDeadline.IsZero() {
+    return copy(b, <-c.inCh), nil
+  }
+
+  timer := time.NewTimer(time.Until(c.readDeadline))
+  defer timer.Stop()
+  select {
+  case data := <-c.inCh:
+    return copy(b, data), nil
+  case <-timer.C:
+    return 0, os.ErrDeadlineExceeded
+  }
 }
 
 // Write immediately with the main connection
@@ -45,25 +59,29 @@ func (c *FauxConn) RemoteAddr() net.Addr {
   return c.addr
 }
 
-// Dummies to satisfy the interface
-
-func (c *FauxConn) LocalAddr() net.Addr {
-  return c.addr
-}
+// Reads are the only thing that can block, so the read deadline is the only
+// one that matters
 
 func (c *FauxConn) SetDeadline(t time.Time) error {
-  return nil
+  return c.SetReadDeadline(t)
 }
 
 func (c *FauxConn) SetReadDeadline(t time.Time) error {
+  c.readDeadline = t
   return nil
 }
 
+// Dummies to satisfy the interface
+
+func (c *FauxConn) LocalAddr() net.Addr {
+  return c.addr
+}
+
 func (c *FauxConn) SetWriteDeadline(t time.Time) error {
   return nil
 }
 
 func NewFauxConn(addr net.Addr, mainConn net.PacketConn, closeCh chan string) *FauxConn {
-  return &FauxConn{make(chan []byte, 10), addr, mainConn, closeCh}
+  return &FauxConn{inCh: make(chan []byte, 10), addr: addr, mainConn: mainConn, closeCh: closeCh}
 }
 
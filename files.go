@@ -0,0 +1,117 @@
+/* Gavin Langdon
+ * Network Programming
+ * Spring 2013
+ * Chat server
+ */
+
+// Files are uploaded to the server in DATA chunks after a SENDFILE, and kept
+// for a while for the recipients to GETFILE
+
+package main
+
+import (
+  "time"
+)
+
+// Largest single file
+const MaxFileSize = 1 << 20
+// How much one user can have stored at once
+const UserFileQuota = 4 << 20
+// How much the server stores altogether
+const FileStoreQuota = 64 << 20
+// How long a file is kept once it's all there
+const FileLifetime = time.Hour
+// How long an upload can go without a DATA before it's given up on
+const UploadTimeout = MessageAssemblyTimeout
+
+// How much file goes in each DATA line we send, before base64. UDP clients
+// get less so each line fits a 1024 byte datagram
+const FileChunkLength = 3000
+const FileDatagramChunkLength = 600
+
+type File struct {
+  id uint64
+  from string
+  target string
+  name string
+  size int
+
+  // Uploaded so far
+  data []byte
+  // Pushed back by each DATA until the file is complete, then set for good
+  expires time.Time
+}
+
+func (f *File) Complete() bool {
+  return len(f.data) == f.size
+}
+
+type FileStore struct {
+  lastId uint64
+  files map[uint64] *File
+
+  // Bytes stored, per user and altogether. Uploads count as they arrive, so
+  // a SENDFILE for a big file that never comes doesn't use anything up
+  used map[string] int
+  total int
+}
+
+func NewFileStore() *FileStore {
+  return &FileStore{0, make(map[uint64] *File), make(map[string] int), 0}
+}
+
+// Start a new file. Whether there's room for it is checked as it arrives
+func (s *FileStore) Start(from string, target string, name string, size int) (*File, error) {
+  if size > MaxFileSize {
+    return nil, NewChatError(CodeTooLarge, "File too large")
+  }
+
+  s.lastId++
+  file := &File{s.lastId, from, target, name, size, nil, time.Now().Add(UploadTimeout)}
+  s.files[file.id] = file
+  return file, nil
+}
+
+// Add the next piece of a file, if there's room for it
+func (s *FileStore) Append(file *File, data []byte) error {
+  if s.used[file.from] + len(data) > UserFileQuota {
+    return NewChatError(CodeTooLarge, "You have too much stored already")
+  }
+  if s.total + len(data) > FileStoreQuota {
+    return NewChatError(CodeTooLarge, "The server has too much stored already")
+  }
+
+  file.data = append(file.data, data...)
+  s.used[file.from] += len(data)
+  s.total += len(data)
+
+  if file.Complete() {
+    file.expires = time.Now().Add(FileLifetime)
+  } else {
+    file.expires = time.Now().Add(UploadTimeout)
+  }
+  return nil
+}
+
+func (s *FileStore) Get(id uint64) *File {
+  return s.files[id]
+}
+
+func (s *FileStore) Remove(file *File) {
+  delete(s.files, file.id)
+  s.used[file.from] -= len(file.data)
+  if s.used[file.from] == 0 {
+    delete(s.used, file.from)
+  }
+  s.total -= len(file.data)
+}
+
+// Throw away files whose time is up, and uploads that have stalled
+func (s *FileStore) Expire() {
+  now := time.Now()
+  for _, file := range s.files {
+    if now.After(file.expires) {
+      s.Remove(file)
+    }
+  }
+}
@@ -0,0 +1,196 @@
+/* Gavin Langdon
+ * Network Programming
+ * Spring 2013
+ * Chat server
+ */
+
+// Every message that goes through the dispatcher gets an ID and a timestamp
+// and is remembered for a while, so clients can refer back to it and search it
+
+package main
+
+import (
+  "sort"
+  "strings"
+  "time"
+  "unicode"
+)
+
+// How many messages the server remembers, across all channels and users
+const HistorySize = 1000
+
+// How many messages HISTORY sends when it isn't given a count
+const HistoryDefaultCount = 20
+
+// How many results SEARCH sends at a time
+const SearchPageSize = 20
+
+type History struct {
+  // IDs start at 1 and only go up
+  lastId uint64
+
+  // Oldest first
+  messages []*Message
+  byId map[uint64] *Message
+
+  // IDs of the messages each word appears in
+  index map[string] map[uint64] bool
+}
+
+func NewHistory() *History {
+  return &History{0, nil, make(map[uint64] *Message), make(map[string] map[uint64] bool)}
+}
+
+// The words in some text, as they're indexed: lower case letters and digits
+func Words(text string) []string {
+  return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+    return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+  })
+}
+
+func (h *History) indexMessage(message *Message) {
+  for _, word := range Words(string(message.text)) {
+    if h.index[word] == nil {
+      h.index[word] = make(map[uint64] bool)
+    }
+    h.index[word][message.id] = true
+  }
+}
+
+func (h *History) unindexMessage(message *Message) {
+  for _, word := range Words(string(message.text)) {
+    delete(h.index[word], message.id)
+    if len(h.index[word]) == 0 {
+      delete(h.index, word)
+    }
+  }
+}
+
+// Give a message its ID and timestamp, and remember it
+func (h *History) Add(message *Message) {
+  h.lastId++
+  message.id = h.lastId
+  message.time = time.Now()
+
+  if len(h.messages) >= HistorySize {
+    h.unindexMessage(h.messages[0])
+    delete(h.byId, h.messages[0].id)
+    h.messages = h.messages[1:]
+  }
+  h.messages = append(h.messages, message)
+  h.byId[message.id] = message
+  h.indexMessage(message)
+}
+
+// Change a message's text
+func (h *History) Edit(message *Message, text []byte) {
+  h.unindexMessage(message)
+  message.text = text
+  message.edited = time.Now()
+  h.indexMessage(message)
+}
+
+// A message by ID, nil if it's been forgotten or never existed
+func (h *History) Get(id uint64) *Message {
+  return h.byId[id]
+}
+
+// Forget a message
+func (h *History) Remove(id uint64) {
+  if message := h.byId[id]; message != nil {
+    h.unindexMessage(message)
+  }
+  delete(h.byId, id)
+  for i, message := range h.messages {
+    if message.id == id {
+      h.messages = append(h.messages[:i], h.messages[i+1:]...)
+      return
+    }
+  }
+}
+
+// The newest messages before the given ID (0 for none) with every word of the
+// query, that match says can be included. More is whether there are older ones
+func (h *History) Search(query []string, before uint64, match func(*Message) bool) (found []*Message, more bool) {
+  if len(query) == 0 {
+    return nil, false
+  }
+
+  // Go through the rarest word's messages, checking for the rest
+  rarest := h.index[query[0]]
+  for _, word := range query[1:] {
+    if len(h.index[word]) < len(rarest) {
+      rarest = h.index[word]
+    }
+  }
+
+  var ids []uint64
+  for id := range rarest {
+    if before == 0 || id < before {
+      ids = append(ids, id)
+    }
+  }
+  sort.Slice(ids, func(i, j int) bool { return ids[i] > ids[j] })
+
+  for _, id := range ids {
+    message := h.byId[id]
+    if !h.hasWords(id, query) || !match(message) {
+      continue
+    }
+    if len(found) == SearchPageSize {
+      return found, true
+    }
+    found = append(found, message)
+  }
+  return found, false
+}
+
+func (h *History) hasWords(id uint64, words []string) bool {
+  for _, word := range words {
+    if !h.index[word][id] {
+      return false
+    }
+  }
+  return true
+}
+
+// Replies to a message, oldest first
+func (h *History) Replies(id uint64) []*Message {
+  var found []*Message
+  for _, message := range h.messages {
+    if message.parent == id {
+      found = append(found, message)
+    }
+  }
+  return found
+}
+
+// The last count messages sent to a target, oldest first
+func (h *History) Target(target string, count int) []*Message {
+  return h.Last(count, func(message *Message) bool {
+    return message.target == target
+  })
+}
+
+// The last count direct messages between two users, oldest first
+func (h *History) Conversation(a string, b string, count int) []*Message {
+  key := ConversationKey(a, b)
+  return h.Last(count, func(message *Message) bool {
+    return message.target[0] != '@' && ConversationKey(message.from, message.target) == key
+  })
+}
+
+// The last count messages that match, oldest first
+func (h *History) Last(count int, match func(*Message) bool) []*Message {
+  var found []*Message
+  for i := len(h.messages) - 1; i >= 0 && len(found) < count; i-- {
+    if match(h.messages[i]) {
+      found = append(found, h.messages[i])
+    }
+  }
+
+  for i, j := 0, len(found) - 1; i < j; i, j = i + 1, j - 1 {
+    found[i], found[j] = found[j], found[i]
+  }
+  return found
+}
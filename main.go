@@ -8,24 +8,20 @@
 package main
 
 import (
+  "fmt"
   "net"
   "container/list"
   "flag"
 )
 
 var VerboseMode = flag.Bool("v", false, "Verbose mode--enables logging of messages")
+var MultiLogin = flag.Bool("m", false, "Allow several simultaneous connections per user")
+var LegacyAuth = flag.Bool("legacyauth", true, "Allow USER logins, which send the password in the clear")
+var WaitShort = flag.Bool("waitshort", false, "When a message is shorter than its declared length, keep reading lines instead of refusing it")
+var JSONPort = flag.String("json", "", "Also listen on this TCP port for clients speaking JSON from the start")
+var AuthBackend = flag.String("auth", "memory", "Authentication backend--memory, htpasswd:FILE, exec:COMMAND, or directory:HOST:PORT")
 var ListenPort string
 
-func init() {
-  flag.Parse()
-
-  if flag.NArg() < 1 {
-    panic("Port not specified")
-  }
-
-  ListenPort = ":" + flag.Arg(0)
-}
-
 // Custom list so we have a Find method
 type List struct {
   *list.List
@@ -45,7 +41,7 @@ func listen(listener net.Listener, mainChan chan net.Conn) {
   for {
     conn, err := listener.Accept()
     if err != nil {
-      err.Error()
+      fmt.Println(err)
       return
     }
     // Send new connection to the dispatcher loop
@@ -53,6 +49,19 @@ func listen(listener net.Listener, mainChan chan net.Conn) {
   }
 }
 
+// Listen to the JSON port, marking connections so they start in JSON mode
+func listenJSON(listener net.Listener, mainChan chan net.Conn) {
+  defer listener.Close()
+  for {
+    conn, err := listener.Accept()
+    if err != nil {
+      fmt.Println(err)
+      return
+    }
+    mainChan <- &JSONConn{conn}
+  }
+}
+
 type UDPListener struct {
   connSet map[string] *FauxConn
   mainConn net.PacketConn
@@ -101,20 +110,36 @@ func listenUDP(mainChan chan net.Conn) error {
       // Inform the dispatcher of the new connection
       mainChan <- fc
     }
-    // Send buffer to the client's buffer channel
-    fc.inCh <- buf[:count]
+    // Send buffer to the client's buffer channel. Each datagram is a line
+    // of its own whether or not the client ended it with a newline
+    data := buf[:count]
+    if count == 0 || data[count-1] != '\n' {
+      data = append(data, '\n')
+    }
+    fc.inCh <- data
   }
-
-  return nil
 }
 
 func main() {
+  // Parsed here rather than in init so tests can set up their own flags
+  flag.Parse()
+  if flag.NArg() < 1 {
+    panic("Port not specified")
+  }
+  ListenPort = ":" + flag.Arg(0)
+
   var err error
 
+  auth, err := NewAuthenticator(*AuthBackend)
+  if err != nil {
+    fmt.Println(err)
+    return
+  }
+
   mainChan := make(chan net.Conn, 10)
 
   // Start dispatch loop
-  go Dispatch(mainChan)
+  go Dispatch(mainChan, auth)
 
   listener, err := net.Listen("tcp", ListenPort)
   defer listener.Close()
@@ -122,6 +147,15 @@ func main() {
     return
   }
 
+  if *JSONPort != "" {
+    jsonListener, err := net.Listen("tcp", ":" + *JSONPort)
+    if err != nil {
+      fmt.Println(err)
+      return
+    }
+    go listenJSON(jsonListener, mainChan)
+  }
+
   // start udp loop
   go listenUDP(mainChan)
   // Start TCP loop
@@ -11,15 +11,66 @@ package main
 import (
   "strconv"
   "fmt"
-  "errors"
   "bytes"
   "math/rand"
+  "net"
+  "regexp"
+  "sort"
+  "strings"
+  "time"
+  "unicode/utf8"
 )
 
+// Longest text that can go in a single short-format line
+const MaxShortLength = 99
+// Longest text that can go in a single C<n> chunk
+const MaxChunkLength = 999
+// Longest line we send a UDP client, so it fits a 1024 byte read
+const MaxDatagramLength = 1024
+// What a chunk needs besides the header: C999, a whole character and the newline
+const MinChunkRoom = len("C999 \n") + utf8.UTFMax
+// Longest message, however many chunks it comes in
+const MaxMessageLength = 64 * 1024
+// How long a client gets to send all the chunks of a message
+const MessageAssemblyTimeout = 30 * time.Second
+
+// Kinds of message besides the normal FROM ones
+const (
+  KindAction = "ACTION" // /me does something
+  KindNotice = "NOTICE" // never answered automatically
+  KindSystem = "SYSTEM" // from the server itself
+)
+
+// Who system messages are from, which can't be anybody's username
+const SystemSender = "*"
+
 type Message struct {
+  // What kind of line this is, FROM if empty. Besides the kinds above, changes
+  // to other messages are sent as messages of their own (EDIT, DELETE...)
+  event string
+
   from string
   target string
-  chunks [][]byte
+
+  // Given out by the dispatcher when the message is sent, see History
+  id uint64
+  time time.Time
+  // When the text was last changed with EDIT
+  edited time.Time
+  // On EDIT and DELETE events, who made the change, which can be a channel
+  // operator rather than the author
+  editor string
+  // The message this one answers, 0 if none. Threads are only one deep
+  parent uint64
+  // Usernames that reacted with each emoji
+  reactions map[string] map[string] bool
+
+  // Accounts the message went to, which hear about edits to it
+  recipients []string
+
+  // The text with the length specifiers stripped; each protocol frames it
+  // its own way when it's sent
+  text []byte
 }
 
 // Random messages to send per the requirements
@@ -40,22 +91,51 @@ var RandomStrings = []string {
 // Find a random message and send to client
 func NewRandomMessage(from *Client, to *Client) (*Message, error) {
   str := RandomStrings[rand.Intn(len(RandomStrings)-1)]
-  var msg Message
-  msg.from = from.username
-  msg.target = to.username
+  return NewTextMessage(from.username, to.username, []byte(str)), nil
+}
 
-  data := []byte(strconv.Itoa(len(str)) + " " + str)
-  _, err := msg.FirstMessageChunk(data)
-  return &msg, err
+// Creates a message from text that was already framed for us
+func NewTextMessage(from string, target string, text []byte) *Message {
+  return &Message{from: from, target: target, text: text}
 }
 
+// The keyword the message is sent to a client with. Clients that don't know
+// about kinds get actions and notices as normal messages
+func (m *Message) Event(cl *Client) string {
+  if m.event == "" || (m.event == KindAction || m.event == KindNotice) && !cl.Has(CapKinds) {
+    return "FROM"
+  }
+  return m.event
+}
+
+var mentionregex = regexp.MustCompile("(^|[^[:alnum:]])@([[:alnum:]]+)")
+
+// Usernames @named in the text, each once
+func (m *Message) Mentions() []string {
+  var names []string
+  seen := make(map[string] bool)
+  for _, match := range mentionregex.FindAllSubmatch(m.text, -1) {
+    if name := string(match[2]); !seen[name] {
+      seen[name] = true
+      names = append(names, name)
+    }
+  }
+  return names
+}
+
+// Creates a message from the server
+func NewSystemMessage(target string, text string) *Message {
+  m := NewTextMessage(SystemSender, target, []byte(text))
+  m.event = KindSystem
+  return m
+}
 
 // Creates a new message from a request data packet and returns it
 func NewMessage(data []byte, client *Client) (*Message, error) {
   spl := bytes.SplitN(data, []byte(" "), 2)
 
   if len(spl) < 2 {
-    return nil, errors.New("Missing argument(s)")
+    return nil, ErrMissingArguments
   }
 
   var msg Message
@@ -63,81 +143,268 @@ func NewMessage(data []byte, client *Client) (*Message, error) {
   msg.from = client.username
   msg.target = string(spl[0])
 
+  // Don't let a stalled client hold on to its session forever, whether it's
+  // sending chunks or the rest of a -waitshort message
+  client.SetReadDeadline(time.Now().Add(MessageAssemblyTimeout))
+  defer client.SetReadDeadline(time.Time{})
+
   // If the message is chunked, use this opportunity to wait for all the chunks
   // (we're still in the client goroutine)
-  more, err := msg.FirstMessageChunk(spl[1])
+  more, err := msg.AddMessageChunk(client, spl[1])
+  if ne, ok := err.(net.Error); ok && ne.Timeout() {
+    return nil, ErrMessageTimeout
+  }
   if err != nil {
     return nil, err
   }
 
+  tooLarge := false
   for more {
-    buf := make([]byte, 1024)
-    count, err := client.Read(buf)
+    line, err := client.ReadLine()
+    if ne, ok := err.(net.Error); ok && ne.Timeout() {
+      return nil, ErrMessageTimeout
+    }
     if err != nil {
       return nil, err
     }
-    if count <= 0 {
-      continue
-    }
 
     if *VerboseMode {
-      fmt.Println(string(buf[:count]))
+      fmt.Println(string(line))
     }
 
-    more, err = msg.AddMessageChunk(bytes.Trim(buf[:count], "\r\n"))
+    if bytes.Equal(bytes.ToUpper(line), []byte("ABORT")) {
+      return nil, ErrMessageAborted
+    }
+
+    more, err = msg.AddMessageChunk(client, line)
+    if ne, ok := err.(net.Error); ok && ne.Timeout() {
+      return nil, ErrMessageTimeout
+    }
     if err != nil {
       return nil, err
     }
+
+    // Once it's too big, keep reading so the rest of the chunks aren't taken
+    // as requests, but don't keep them
+    if len(msg.text) > MaxMessageLength {
+      tooLarge = true
+      msg.text = msg.text[:0]
+    }
   }
 
+  if tooLarge {
+    return nil, ErrMessageTooLarge
+  }
   return &msg, nil
 }
 
-func (m *Message) FirstMessageChunk(data []byte) (bool, error) {
-  // If the message is chunked, use this opportunity to wait for all the chunks
-  // (we're still in the client goroutine)
-  more, err := m.AddMessageChunk(data)
-  if err != nil {
-    return false, err
+func (m *Message) AddMessageChunk(client *Client, data []byte) (bool, error) {
+  if len(data) == 0 {
+    return false, ErrMalformedPacket
   }
 
-  // Add FROM header to first chunk
-  m.chunks[0] = append([]byte("FROM " + m.from + " "), m.chunks[0]...)
-  return more, nil
-}
+  var payload []byte
 
-func (m *Message) AddMessageChunk(data []byte) (bool, error) {
   // Split message length specifier and message
   spl := bytes.SplitN(data, []byte(" "), 2)
 
+  // A space first leaves no length specifier at all
+  if len(spl[0]) == 0 {
+    return false, ErrMalformedPacket
+  }
+
   // If the beginning of the length specifier is C we're chunked
   if spl[0][0] == 'C' {
     // Make sure this is an actual length specifier and get the count
-    if count, err := strconv.Atoi(string(spl[0][1:])); err == nil {
-      if count > 999 {
-        return false, errors.New("Packet size too large")
+    if count, err := strconv.Atoi(string(spl[0][1:])); err == nil && count >= 0 {
+      if count > MaxChunkLength {
+        return false, NewChatError(CodeTooLarge, "Packet size too large")
       }
-      m.chunks = append(m.chunks, append(data, '\n'))
+      if len(spl) == 2 {
+        payload = spl[1]
+      }
+      payload, err = readDeclared(client, count, payload)
+      if err != nil {
+        return false, err
+      }
+      m.text = append(m.text, payload...)
       // Return false if C0/done
       return count != 0, nil
     }
-  } else if count, err := strconv.Atoi(string(spl[0])); len(spl) == 2 && err == nil {
-    if count > 99 {
-      return false, errors.New("Packet size too large for short format")
+  } else if count, err := strconv.Atoi(string(spl[0])); len(spl) == 2 && err == nil && count >= 0 {
+    if count > MaxShortLength {
+      return false, NewChatError(CodeTooLarge, "Packet size too large for short format")
+    }
+    payload, err = readDeclared(client, count, spl[1])
+    if err != nil {
+      return false, err
     }
-    m.chunks = append(m.chunks, append(data, '\n'))
+    m.text = append(m.text, payload...)
     // Single packet, return false
     return false, nil
   }
-  return false, errors.New("Malformed packet ")
+  return false, ErrMalformedPacket
 }
 
+// Check a payload against its declared length in bytes. With -waitshort, a
+// short payload means the line ending was part of the message, so the rest
+// is read straight off the connection
+func readDeclared(client *Client, count int, payload []byte) ([]byte, error) {
+  if len(payload) == count {
+    return payload, nil
+  }
+  if len(payload) > count || !*WaitShort {
+    return nil, lengthMismatch(count, payload)
+  }
+
+  payload = append(payload, client.lineEnding...)
+  if len(payload) > count {
+    return nil, lengthMismatch(count, payload)
+  }
+  rest, err := client.ReadBytes(count - len(payload))
+  if err != nil {
+    return nil, err
+  }
+  payload = append(payload, rest...)
 
-func (m *Message) GetChunks() [][]byte {
-  return m.chunks
+  // The message has to finish where it said it would
+  line, err := client.ReadLine()
+  if err != nil {
+    return nil, err
+  }
+  if len(line) != 0 {
+    return nil, lengthMismatch(count, append(payload, line...))
+  }
+  return payload, nil
+}
+
+func lengthMismatch(count int, payload []byte) error {
+  // The usual mistake is counting characters instead of bytes
+  if utf8.RuneCount(payload) == count {
+    return NewChatError(CodeLengthMismatch, "Lengths count bytes, not characters: that message is " +
+      strconv.Itoa(len(payload)) + " bytes")
+  }
+  return NewChatError(CodeLengthMismatch, "Declared length " + strconv.Itoa(count) +
+    " doesn't match the " + strconv.Itoa(len(payload)) + " bytes sent")
 }
 
-// Write all chunks in sequence to the client
+// The message's ID and timestamp (in Unix milliseconds) as name=value pairs,
+// for clients that asked for them
+func (m *Message) Attributes(cl *Client) []string {
+  if !cl.Has(CapMsgId) || m.id == 0 {
+    return nil
+  }
+  attrs := []string{"id=" + strconv.FormatUint(m.id, 10), "time=" + unixMillis(m.time)}
+  if !m.edited.IsZero() {
+    attrs = append(attrs, "edited=" + unixMillis(m.edited))
+  }
+  if m.editor != "" {
+    attrs = append(attrs, "editor=" + m.editor)
+  }
+  if m.parent != 0 {
+    attrs = append(attrs, "parent=" + strconv.FormatUint(m.parent, 10))
+  }
+  if len(m.reactions) > 0 {
+    var counts []string
+    for _, emoji := range m.Reactions() {
+      counts = append(counts, emoji + ":" + strconv.Itoa(len(m.reactions[emoji])))
+    }
+    attrs = append(attrs, "reactions=" + strings.Join(counts, ","))
+  }
+  return attrs
+}
+
+// Whether a user got a message, or sent it
+func (m *Message) SentTo(username string) bool {
+  if m.from == username {
+    return true
+  }
+  for _, recipient := range m.recipients {
+    if recipient == username {
+      return true
+    }
+  }
+  return false
+}
+
+// Add a user's reaction. False if they'd already reacted that way
+func (m *Message) React(username string, emoji string) bool {
+  if m.reactions == nil {
+    m.reactions = make(map[string] map[string] bool)
+  }
+  if m.reactions[emoji] == nil {
+    m.reactions[emoji] = make(map[string] bool)
+  }
+  if m.reactions[emoji][username] {
+    return false
+  }
+  m.reactions[emoji][username] = true
+  return true
+}
+
+// The emoji reacted with, in order
+func (m *Message) Reactions() []string {
+  var emoji []string
+  for e := range m.reactions {
+    emoji = append(emoji, e)
+  }
+  sort.Strings(emoji)
+  return emoji
+}
+
+func unixMillis(t time.Time) string {
+  return strconv.FormatInt(t.UnixNano() / int64(time.Millisecond), 10)
+}
+
+// Split the text into the line protocol's framing: one short-format line if
+// it fits, otherwise C<n> chunks finished off with C0. The header goes in
+// front of the first line. Each line is at most maxLine bytes, or as long as
+// the format allows if maxLine is 0
+func (m *Message) Chunks(header string, maxLine int) [][]byte {
+  short := header + strconv.Itoa(len(m.text)) + " " + string(m.text) + "\n"
+  if len(m.text) <= MaxShortLength && (maxLine == 0 || len(short) <= maxLine) {
+    return [][]byte{[]byte(short)}
+  }
+
+  var chunks [][]byte
+  for text := m.text; len(text) > 0; {
+    n := chunkLength(text, len(header), maxLine)
+    chunks = append(chunks, []byte(header + "C" + strconv.Itoa(n) + " " + string(text[:n]) + "\n"))
+    text = text[n:]
+    // Only the first chunk gets the header
+    header = ""
+  }
+  return append(chunks, []byte("C0\n"))
+}
+
+// How much of the text goes in the next chunk
+func chunkLength(text []byte, headerLength int, maxLine int) int {
+  n := MaxChunkLength
+  if maxLine > 0 {
+    // Leave room for the header, C999 and the newline
+    if room := maxLine - headerLength - len("C999 \n"); room < n {
+      n = room
+    }
+  }
+  if n < 1 {
+    n = 1
+  }
+  if n >= len(text) {
+    return len(text)
+  }
+
+  // Don't split a character between chunks
+  cut := n
+  for cut > 0 && !utf8.RuneStart(text[cut]) {
+    cut--
+  }
+  if cut == 0 {
+    return n
+  }
+  return cut
+}
+
+// Write all chunks in sequence to the client, framed by its protocol
 func (m *Message) WriteTo(c *Client) (n int, err error) {
   var strbuf bytes.Buffer
 
@@ -145,8 +412,12 @@ func (m *Message) WriteTo(c *Client) (n int, err error) {
     strbuf.WriteString("SENT to " + c.String() + ": ")
   }
 
-  ch := m.GetChunks()
+  ch := c.protocol.EncodeMessage(c, m)
   n = 0
+
+  // Keep the chunks together when a response goes out at the same time
+  c.writeMu.Lock()
+  defer c.writeMu.Unlock()
   for i := range ch {
     wr, err := c.Write(ch[i])
     if *VerboseMode {
@@ -0,0 +1,183 @@
+/* Gavin Langdon
+ * Network Programming
+ * Spring 2013
+ * Chat server
+ */
+
+package main
+
+import (
+  "bytes"
+  "net"
+  "strings"
+  "testing"
+)
+
+// A client reading from one end of a pipe, with whatever's given written
+// into the other end
+func pipeClient(t *testing.T, input string) *Client {
+  server, client := net.Pipe()
+  t.Cleanup(func() { server.Close(); client.Close() })
+  go client.Write([]byte(input))
+  cl := (&Dispatcher{}).NewClient(server)
+  cl.lineEnding = []byte("\n")
+  return cl
+}
+
+func TestAddMessageChunk(t *testing.T) {
+  tests := []struct {
+    data string
+    more bool
+    text string
+  }{
+    {"5 hello", false, "hello"},
+    {"0 ", false, ""},
+    {"11 hello world", false, "hello world"},
+    {"C5 hello", true, "hello"},
+    {"C0", false, ""},
+    {"C0 ", false, ""},
+    {"6 h\xc3\xa9llo", false, "h\xc3\xa9llo"},
+  }
+  for _, test := range tests {
+    var m Message
+    more, err := m.AddMessageChunk(pipeClient(t, ""), []byte(test.data))
+    if err != nil {
+      t.Errorf("%q: %v", test.data, err)
+      continue
+    }
+    if more != test.more || string(m.text) != test.text {
+      t.Errorf("%q = %v %q, want %v %q", test.data, more, m.text, test.more, test.text)
+    }
+  }
+}
+
+func TestAddMessageChunkRefuses(t *testing.T) {
+  tests := []struct {
+    data string
+    want ReplyCode
+  }{
+    {"", CodeBadRequest},
+    {" ", CodeBadRequest},
+    {" 5 hello", CodeBadRequest},
+    {" C5 x", CodeBadRequest},
+    {"hello", CodeBadRequest},
+    {"5", CodeBadRequest},
+    {"-1 x", CodeBadRequest},
+    {"C-1 x", CodeBadRequest},
+    {"Cx hello", CodeBadRequest},
+    {"4 hello", CodeLengthMismatch},
+    {"6 hello", CodeLengthMismatch},
+    {"C4 hello", CodeLengthMismatch},
+    {"5 h\xc3\xa9llo", CodeLengthMismatch},
+    {"100 " + strings.Repeat("x", 100), CodeTooLarge},
+    {"C1000 " + strings.Repeat("x", 1000), CodeTooLarge},
+  }
+  for _, test := range tests {
+    var m Message
+    if _, err := m.AddMessageChunk(pipeClient(t, ""), []byte(test.data)); ErrorCode(err) != test.want {
+      t.Errorf("%q: got %v, want code %d", test.data, err, test.want)
+    }
+  }
+}
+
+func TestReadDeclaredWaitShort(t *testing.T) {
+  defer func(old bool) { *WaitShort = old }(*WaitShort)
+  *WaitShort = true
+
+  // The newline after "hello" was part of the message
+  payload, err := readDeclared(pipeClient(t, "wor\n"), 9, []byte("hello"))
+  if err != nil || string(payload) != "hello\nwor" {
+    t.Errorf("got %q %v, want %q", payload, err, "hello\nwor")
+  }
+
+  // More on the last line than was declared
+  if _, err := readDeclared(pipeClient(t, "world\n"), 9, []byte("hello")); ErrorCode(err) != CodeLengthMismatch {
+    t.Errorf("overlong: got %v, want code %d", err, CodeLengthMismatch)
+  }
+
+  // Longer than declared is never waited on
+  if _, err := readDeclared(pipeClient(t, ""), 3, []byte("hello")); ErrorCode(err) != CodeLengthMismatch {
+    t.Errorf("too long: got %v, want code %d", err, CodeLengthMismatch)
+  }
+}
+
+func TestChunksShort(t *testing.T) {
+  m := Message{text: []byte("hello")}
+  chunks := m.Chunks("SAY bob ", 0)
+  if len(chunks) != 1 || string(chunks[0]) != "SAY bob 5 hello\n" {
+    t.Errorf("got %q", chunks)
+  }
+}
+
+// Each set of chunks has to stay under its line length and come back
+// together as the same text
+func TestChunks(t *testing.T) {
+  tests := []struct {
+    header string
+    text string
+    maxLine int
+  }{
+    {"SAY bob ", strings.Repeat("x", 100), 0},
+    {"SAY bob ", strings.Repeat("x", 2500), 0},
+    {"SAY bob ", strings.Repeat("x", 60), 50},
+    {"SAY bob ", strings.Repeat("x", 3000), MaxDatagramLength},
+    {"SAY bob " + strings.Repeat("a", 900) + " ", strings.Repeat("x", 500), MaxDatagramLength},
+    {"SAY bob ", strings.Repeat("\u00e9\u20ac", 700), MaxDatagramLength},
+    {"SAY bob ", strings.Repeat("\u20ac", 50), 30},
+  }
+  for _, test := range tests {
+    m := Message{text: []byte(test.text)}
+    chunks := m.Chunks(test.header, test.maxLine)
+    if !bytes.HasPrefix(chunks[0], []byte(test.header)) {
+      t.Errorf("%d bytes: first chunk %q doesn't start with the header", len(test.text), chunks[0])
+      continue
+    }
+    chunks[0] = chunks[0][len(test.header):]
+
+    var got Message
+    for i, chunk := range chunks {
+      length := len(chunk)
+      if i == 0 {
+        length += len(test.header)
+      }
+      if test.maxLine > 0 && length > test.maxLine {
+        t.Errorf("%d bytes: chunk %d is %d bytes, over %d", len(test.text), i, length, test.maxLine)
+      }
+      more, err := got.AddMessageChunk(pipeClient(t, ""), bytes.TrimSuffix(chunk, []byte("\n")))
+      if err != nil {
+        t.Errorf("%d bytes: chunk %d %q: %v", len(test.text), i, chunk, err)
+        break
+      }
+      if more != (i < len(chunks) - 1) {
+        t.Errorf("%d bytes: chunk %d of %d says more is %v", len(test.text), i, len(chunks), more)
+      }
+    }
+    if string(got.text) != test.text {
+      t.Errorf("%d bytes: came back as %d bytes", len(test.text), len(got.text))
+    }
+  }
+}
+
+func TestChunkLength(t *testing.T) {
+  euro := []byte(strings.Repeat("\u20ac", 10))
+  tests := []struct {
+    text []byte
+    headerLength int
+    maxLine int
+    want int
+  }{
+    {[]byte("hello"), 8, 0, 5},
+    {bytes.Repeat([]byte("x"), 2000), 8, 0, MaxChunkLength},
+    {bytes.Repeat([]byte("x"), 2000), 100, MaxDatagramLength, MaxDatagramLength - 100 - len("C999 \n")},
+    {bytes.Repeat([]byte("x"), 2000), 0, 20, 20 - len("C999 \n")},
+    // 14 bytes of room ends partway through the fifth euro sign
+    {euro, 0, 20, 12},
+    // No room left still makes progress
+    {[]byte("hello"), 50, 20, 1},
+  }
+  for _, test := range tests {
+    if got := chunkLength(test.text, test.headerLength, test.maxLine); got != test.want {
+      t.Errorf("chunkLength(%d bytes, %d, %d) = %d, want %d", len(test.text), test.headerLength, test.maxLine, got, test.want)
+    }
+  }
+}
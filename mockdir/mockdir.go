@@ -0,0 +1,92 @@
+/* Gavin Langdon
+ * Network Programming
+ * Spring 2013
+ * Chat server
+ */
+
+// A directory server for testing -auth directory: against. It holds plain text
+// passwords from user:password lines and speaks the same BIND protocol
+//
+//   go run mockdir/mockdir.go 3890 users.txt
+//   ./chat -auth directory:localhost:3890 12180
+
+package main
+
+import (
+  "bufio"
+  "fmt"
+  "net"
+  "os"
+  "strings"
+)
+
+// Read user:password lines, skipping blanks and # comments
+func readUsers(path string) (map[string] string, error) {
+  file, err := os.Open(path)
+  if err != nil {
+    return nil, err
+  }
+  defer file.Close()
+
+  users := make(map[string] string)
+  scanner := bufio.NewScanner(file)
+  for scanner.Scan() {
+    line := strings.TrimSpace(scanner.Text())
+    if line == "" || line[0] == '#' {
+      continue
+    }
+    spl := strings.SplitN(line, ":", 2)
+    if len(spl) != 2 {
+      return nil, fmt.Errorf("Malformed line in %s: %s", path, line)
+    }
+    users[spl[0]] = spl[1]
+  }
+  return users, scanner.Err()
+}
+
+func handle(conn net.Conn, users map[string] string) {
+  defer conn.Close()
+
+  scanner := bufio.NewScanner(conn)
+  for scanner.Scan() {
+    args := strings.SplitN(scanner.Text(), " ", 3)
+    if len(args) != 3 || args[0] != "BIND" {
+      fmt.Fprintln(conn, "ERROR bad request")
+      continue
+    }
+
+    if password, hit := users[args[1]]; hit && password == args[2] {
+      fmt.Fprintln(conn, "OK")
+    } else {
+      fmt.Fprintln(conn, "ERROR invalid credentials")
+    }
+  }
+}
+
+func main() {
+  if len(os.Args) != 3 {
+    fmt.Println("Usage: mockdir PORT FILE")
+    os.Exit(2)
+  }
+
+  users, err := readUsers(os.Args[2])
+  if err != nil {
+    fmt.Println(err)
+    os.Exit(1)
+  }
+
+  listener, err := net.Listen("tcp", "127.0.0.1:" + os.Args[1])
+  if err != nil {
+    fmt.Println(err)
+    os.Exit(1)
+  }
+
+  for {
+    conn, err := listener.Accept()
+    if err != nil {
+      fmt.Println(err)
+      return
+    }
+    go handle(conn, users)
+  }
+}
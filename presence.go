@@ -0,0 +1,77 @@
+/* Gavin Langdon
+ * Network Programming
+ * Spring 2013
+ * Chat server
+ */
+
+// Users can say whether they're around with AWAY and STATUS. Users who share
+// a channel with them hear about changes, and away users answer direct
+// messages automatically
+
+package main
+
+import (
+  "net/url"
+)
+
+const (
+  StatusOnline = "online"
+  StatusAway = "away"
+  StatusBusy = "busy"
+  // Only ever sent in PRESENCE events, when the last connection goes
+  StatusOffline = "offline"
+)
+
+// Longest status text
+const MaxStatusLength = 200
+
+// What away users answer with when they didn't give a reason
+const DefaultAwayReply = "I'm away right now"
+
+func ValidStatus(status string) bool {
+  return status == StatusOnline || status == StatusAway || status == StatusBusy
+}
+
+func (info *ClientInfo) Status() string {
+  if info.status == "" {
+    return StatusOnline
+  }
+  return info.status
+}
+
+func (info *ClientInfo) SetStatus(status string, text string) {
+  info.status, info.statusText = status, text
+  // Everyone gets answered again after a change
+  info.awayReplied = nil
+}
+
+// The status as it goes in a PRESENCE event: the state, then any text
+func (info *ClientInfo) StatusLine() string {
+  if info.statusText == "" {
+    return info.Status()
+  }
+  return info.Status() + " " + info.statusText
+}
+
+// The username with its status, as USERS and LIST give them to clients with
+// presence: user:state, then :text if there is any, escaped to fit in one word
+func (info *ClientInfo) PresenceString() string {
+  s := info.username + ":" + info.Status()
+  if info.statusText != "" {
+    s += ":" + url.PathEscape(info.statusText)
+  }
+  return s
+}
+
+// Whether a user should be answered automatically, which is only once per
+// time away
+func (info *ClientInfo) ShouldAwayReply(username string) bool {
+  if info.Status() != StatusAway || info.awayReplied[username] {
+    return false
+  }
+  if info.awayReplied == nil {
+    info.awayReplied = make(map[string] bool)
+  }
+  info.awayReplied[username] = true
+  return true
+}
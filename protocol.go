@@ -0,0 +1,300 @@
+/* Gavin Langdon
+ * Network Programming
+ * Spring 2013
+ * Chat server
+ */
+
+// A protocol is how a connection frames requests and how responses and
+// messages are formatted for it. Everyone starts with the line protocol;
+// the json capability (or the -json port) switches to one JSON object per line,
+// and the binary capability to length-prefixed frames
+
+package main
+
+import (
+  "bytes"
+  "encoding/base64"
+  "encoding/binary"
+  "encoding/json"
+  "io"
+  "net"
+  "time"
+  "unicode/utf8"
+)
+
+// A request split up but not yet understood
+type RawRequest struct {
+  tag string
+  code string
+  args []byte
+  // Message text framed by the protocol itself, nil for the line protocol
+  body []byte
+}
+
+type Protocol interface {
+  ReadRequest(cl *Client) (*RawRequest, error)
+  EncodeResponse(cl *Client, rs *Response) []byte
+  // Each frame is written separately
+  EncodeMessage(cl *Client, m *Message) [][]byte
+}
+
+//////////////////////////////////////////////////
+// The original space-delimited line protocol
+
+type TextProtocol struct{}
+
+func (p TextProtocol) ReadRequest(cl *Client) (*RawRequest, error) {
+  line, err := cl.ReadLine()
+  if err != nil {
+    return nil, err
+  }
+
+  var rr RawRequest
+  request := line
+  if cl.Has(CapTags) {
+    rr.tag, request, err = SplitTag(line)
+    if err != nil {
+      return &rr, err
+    }
+  }
+
+  spl := bytes.SplitN(request, []byte(" "), 2)
+  rr.code = string(spl[0])
+  if len(spl) >= 2 {
+    rr.args = spl[1]
+  }
+  return &rr, nil
+}
+
+func (p TextProtocol) EncodeResponse(cl *Client, rs *Response) []byte {
+  return append(rs.Bytes(cl.Has(CapCodes)), '\n')
+}
+
+func (p TextProtocol) EncodeMessage(cl *Client, m *Message) [][]byte {
+  attrs := m.Attributes(cl)
+  header := textHeader(cl, m, attrs)
+
+  // Each chunk is a datagram of its own over UDP, so the first one needs room
+  // for some text after the header. Attributes that don't fit are left off,
+  // last first
+  if _, ok := cl.Conn.(*FauxConn); ok {
+    for len(attrs) > 0 && len(header) + MinChunkRoom > MaxDatagramLength {
+      attrs = attrs[:len(attrs)-1]
+      header = textHeader(cl, m, attrs)
+    }
+    return m.Chunks(header, MaxDatagramLength)
+  }
+  return m.Chunks(header, 0)
+}
+
+func textHeader(cl *Client, m *Message, attrs []string) string {
+  header := m.Event(cl) + " " + m.from + " "
+  // A mention could come from any channel, so it says which
+  if m.event == "MENTION" {
+    header += m.target + " "
+  }
+  for _, attr := range attrs {
+    header += attr + " "
+  }
+  return header
+}
+
+//////////////////////////////////////////////////
+// One JSON object per line
+
+// Connections accepted on the -json port start out in JSON mode
+type JSONConn struct {
+  net.Conn
+}
+
+type JSONProtocol struct{}
+
+type jsonRequest struct {
+  Tag string `json:"tag,omitempty"`
+  Cmd string `json:"cmd"`
+  // Everything after the command in the line protocol
+  Args string `json:"args,omitempty"`
+  // Message text for SAY, no length specifiers needed
+  Text *string `json:"text,omitempty"`
+}
+
+type jsonResponse struct {
+  Tag string `json:"tag,omitempty"`
+  Reply string `json:"reply"`
+  Code ReplyCode `json:"code"`
+  Args []string `json:"args"`
+}
+
+type jsonMessage struct {
+  Event string `json:"event"`
+  From string `json:"from"`
+  Target string `json:"target"`
+  // Only with the msgid capability
+  Id uint64 `json:"id,omitempty"`
+  Time int64 `json:"time,omitempty"`
+  Edited int64 `json:"edited,omitempty"`
+  Editor string `json:"editor,omitempty"`
+  Parent uint64 `json:"parent,omitempty"`
+  Reactions map[string] int `json:"reactions,omitempty"`
+  Text string `json:"text,omitempty"`
+  // Base64 instead of text when the message isn't UTF-8
+  Data string `json:"data,omitempty"`
+}
+
+func (p JSONProtocol) ReadRequest(cl *Client) (*RawRequest, error) {
+  line, err := cl.ReadLineLimit(MaxJSONLineLength)
+  if err != nil {
+    return nil, err
+  }
+
+  var jr jsonRequest
+  if err := json.Unmarshal(line, &jr); err != nil {
+    return nil, NewChatError(CodeBadRequest, "Malformed JSON request")
+  }
+
+  rr := RawRequest{jr.Tag, jr.Cmd, []byte(jr.Args), nil}
+  if jr.Text != nil {
+    if len(*jr.Text) > MaxMessageLength {
+      return &rr, ErrMessageTooLarge
+    }
+    rr.body = []byte(*jr.Text)
+  }
+  return &rr, nil
+}
+
+func (p JSONProtocol) EncodeResponse(cl *Client, rs *Response) []byte {
+  jr := jsonResponse{rs.tag, rs.keyword, rs.code, make([]string, len(rs.args))}
+  for i, arg := range rs.args {
+    jr.Args[i] = string(arg)
+  }
+  return encodeJSONLine(jr)
+}
+
+func (p JSONProtocol) EncodeMessage(cl *Client, m *Message) [][]byte {
+  jm := jsonMessage{Event: m.Event(cl), From: m.from, Target: m.target}
+  if cl.Has(CapMsgId) {
+    jm.Id = m.id
+    jm.Time = m.time.UnixNano() / int64(time.Millisecond)
+    if !m.edited.IsZero() {
+      jm.Edited = m.edited.UnixNano() / int64(time.Millisecond)
+    }
+    jm.Editor = m.editor
+    jm.Parent = m.parent
+    if len(m.reactions) > 0 {
+      jm.Reactions = make(map[string] int)
+      for emoji, users := range m.reactions {
+        jm.Reactions[emoji] = len(users)
+      }
+    }
+  }
+  if utf8.Valid(m.text) {
+    jm.Text = string(m.text)
+  } else {
+    jm.Data = base64.StdEncoding.EncodeToString(m.text)
+  }
+  return [][]byte{encodeJSONLine(jm)}
+}
+
+func encodeJSONLine(v interface{}) []byte {
+  data, err := json.Marshal(v)
+  if err != nil {
+    // Only plain structs of strings go in here
+    panic(err)
+  }
+  return append(data, '\n')
+}
+
+//////////////////////////////////////////////////
+// Binary frames: a uvarint payload length, a type byte, then the payload.
+// Requests are the request line, optionally followed by a zero byte and the
+// message text. Messages are `FROM user target' (or ACTION, EDIT...), any
+// attributes, a zero byte, then the text.
+// Responses are the response line with its reply code
+
+const MaxFrameLength = 1 << 20
+
+const (
+  FrameRequest byte = 1
+  FrameResponse byte = 2
+  FrameMessage byte = 3
+)
+
+type BinaryProtocol struct{}
+
+func (p BinaryProtocol) ReadRequest(cl *Client) (*RawRequest, error) {
+  length, err := binary.ReadUvarint(cl.reader)
+  if err != nil {
+    return nil, err
+  }
+  if length > MaxFrameLength {
+    // We can't find the next frame after this, so hang up
+    err := NewDisconnectError(CodeTooLarge, "Frame too large")
+    return nil, &err
+  }
+
+  frameType, err := cl.reader.ReadByte()
+  if err != nil {
+    return nil, err
+  }
+  payload := make([]byte, length)
+  if _, err := io.ReadFull(cl.reader, payload); err != nil {
+    return nil, err
+  }
+
+  if frameType != FrameRequest {
+    return nil, NewChatError(CodeBadRequest, "Unexpected frame type")
+  }
+
+  var rr RawRequest
+  line := payload
+  if i := bytes.IndexByte(payload, 0); i >= 0 {
+    line, rr.body = payload[:i], payload[i+1:]
+  }
+
+  var request []byte
+  rr.tag, request, err = SplitTag(line)
+  if err != nil {
+    return &rr, err
+  }
+  spl := bytes.SplitN(request, []byte(" "), 2)
+  rr.code = string(spl[0])
+  if len(spl) >= 2 {
+    rr.args = spl[1]
+  }
+  if len(rr.body) > MaxMessageLength {
+    return &rr, ErrMessageTooLarge
+  }
+  return &rr, nil
+}
+
+func (p BinaryProtocol) EncodeResponse(cl *Client, rs *Response) []byte {
+  return encodeFrame(FrameResponse, rs.Bytes(true))
+}
+
+func (p BinaryProtocol) EncodeMessage(cl *Client, m *Message) [][]byte {
+  payload := []byte(m.Event(cl) + " " + m.from + " " + m.target)
+  for _, attr := range m.Attributes(cl) {
+    payload = append(payload, " " + attr...)
+  }
+  payload = append(payload, 0)
+  payload = append(payload, m.text...)
+  return [][]byte{encodeFrame(FrameMessage, payload)}
+}
+
+func encodeFrame(frameType byte, payload []byte) []byte {
+  frame := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64 + 1 + len(payload))
+  n := binary.PutUvarint(frame, uint64(len(payload)))
+  frame = append(frame[:n], frameType)
+  return append(frame, payload...)
+}
+
+// The protocol a client should be using given its capabilities
+func ProtocolFor(cl *Client) Protocol {
+  switch {
+  case cl.Has(CapBinary):
+    return BinaryProtocol{}
+  case cl.Has(CapJSON):
+    return JSONProtocol{}
+  }
+  return TextProtocol{}
+}
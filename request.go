@@ -10,8 +10,12 @@ package main
 
 import (
   "bytes"
-  "errors"
+  "encoding/base64"
+  "strconv"
+  "strings"
   "math/rand"
+  "unicode"
+  "unicode/utf8"
 )
 
 type Requestable interface {
@@ -22,6 +26,9 @@ type Requestable interface {
   // Handle the request in the dispatcher thread
   Handle(dispatcher *Dispatcher) (*Response, error)
 
+  // Message text the protocol framed for us, before Create
+  SetBody(body []byte)
+
   // Setter and getter for client 
   SetClient(client *Client)
   GetClient() *Client
@@ -32,6 +39,7 @@ type Requestable interface {
 
 type Request struct {
   client *Client
+  body []byte
 }
 
 
@@ -48,6 +56,10 @@ func (rq *Request) Handle(dispatcher *Dispatcher) (*Response, error) {
   return &rs, nil
 }
 
+func (rq *Request) SetBody(body []byte) {
+  rq.body = body
+}
+
 func (rq *Request) SetClient(client *Client) {
   rq.client = client
 }
@@ -56,6 +68,79 @@ func (rq *Request) GetClient() *Client {
   return rq.client
 }
 
+//////////////////////////////////////////////////
+// CHAT version cap cap... negotiates capabilities. CHAT ? advertises what
+// the server supports, and a bare CHAT gets a bare TAHC like it always has
+
+type ChatRequest struct {
+  Request
+  version int
+  caps []string
+  list bool
+}
+
+func (rq *ChatRequest) Create(buf []byte) error {
+  if len(buf) <= 0 {
+    return nil
+  }
+  if string(bytes.TrimSpace(buf)) == "?" {
+    rq.list = true
+    return nil
+  }
+  // Capabilities are settled before login, changing them after would pull
+  // things like resume out from under the session
+  if rq.client.loggedIn {
+    return ErrAlreadyLoggedIn
+  }
+
+  var err error
+  rq.version, rq.caps, err = NegotiateCapabilities(strings.Fields(string(buf)))
+  return err
+}
+
+func (rq *ChatRequest) Handle(dispatcher *Dispatcher) (*Response, error) {
+  if rq.version == 0 && !rq.list {
+    return rq.Request.Handle(dispatcher)
+  }
+
+  rs := NewResponse("TAHC")
+  rs.AppendString(strconv.Itoa(ProtocolVersion))
+
+  if rq.list {
+    for _, c := range Capabilities {
+      rs.AppendString(c)
+    }
+    return &rs, nil
+  }
+
+  rq.client.caps = make(map[string] bool)
+  for _, c := range rq.caps {
+    // Frames can't be found again in UDP once a datagram goes missing, JSON
+    // lines can't be split to fit a datagram, and connections on the JSON
+    // port stay JSON whatever they ask for
+    if c == CapBinary || c == CapJSON {
+      if _, ok := rq.client.Conn.(*FauxConn); ok {
+        continue
+      }
+    }
+    if c == CapBinary {
+      if _, ok := rq.client.Conn.(*JSONConn); ok {
+        continue
+      }
+    }
+    rq.client.caps[c] = true
+    rs.AppendString(c)
+  }
+
+  if _, ok := rq.client.Conn.(*JSONConn); ok {
+    rq.client.caps[CapJSON] = true
+  }
+
+  // This response already goes out in the new protocol
+  rq.client.protocol = ProtocolFor(rq.client)
+  return &rs, nil
+}
+
 //////////////////////////////////////////////////
 // AuthRequest requires the user be logged in
 
@@ -77,18 +162,21 @@ type UserRequest struct {
 
 func (rq *UserRequest) Create(buf []byte) error {
   if rq.client.loggedIn {
-    return errors.New("You are already logged in")
+    return ErrAlreadyLoggedIn
+  }
+  if !*LegacyAuth {
+    return NewChatError(CodeAuthDisabled, "Cleartext logins are disabled, use AUTH " + ScramMechanism)
   }
 
   // Ensure enough arguments
   args := bytes.SplitN(buf, []byte(" "), 2)
   if len(args) != 2 {
-    return errors.New("Invalid User Request")
+    return NewChatError(CodeBadRequest, "Invalid User Request")
   }
 
   // Password must be > 2 chars for bcrypt
   if len(args[1]) < 3 {
-    return errors.New("Password is too short")
+    return NewChatError(CodeBadRequest, "Password is too short")
   }
 
   var err error
@@ -101,7 +189,15 @@ func (rq *UserRequest) Create(buf []byte) error {
 }
 
 func (rq *UserRequest) Handle(dispatcher *Dispatcher) (*Response, error) {
-  if err := dispatcher.ClientLogin(rq.client, rq.id.username, rq.id.password); err != nil {
+  // The password is checked in the background, and we answer after
+  if err := dispatcher.ClientLogin(rq.client, rq.id.username, rq.id.password, rq.finish); err != nil {
+    return rq.finish(err)
+  }
+  return nil, nil
+}
+
+func (rq *UserRequest) finish(err error) (*Response, error) {
+  if err != nil {
     var rs *Response
     if _, ok := err.(*DisconnectError); ok {
       dr := NewFatalErrorResponse(err)
@@ -114,6 +210,141 @@ func (rq *UserRequest) Handle(dispatcher *Dispatcher) (*Response, error) {
   }
 
   rs := NewOkResponse()
+  if rq.client.session != nil {
+    rs.AppendString(rq.client.session.token)
+  }
+  return &rs, nil
+}
+
+//////////////////////////////////////////////////
+// Comes back to the dispatcher when work started with Later is done
+
+type LaterRequest struct {
+  Request
+  err error
+  finish func(error) (*Response, error)
+}
+
+func (rq *LaterRequest) Handle(dispatcher *Dispatcher) (*Response, error) {
+  return rq.finish(rq.err)
+}
+
+//////////////////////////////////////////////////
+// Challenge-response login, first half: AUTH SCRAM-SHA-256 client-first-message
+
+type AuthStartRequest struct {
+  Request
+  exchange *ScramExchange
+}
+
+func (rq *AuthStartRequest) Create(buf []byte) error {
+  if rq.client.loggedIn {
+    return ErrAlreadyLoggedIn
+  }
+
+  args := bytes.SplitN(buf, []byte(" "), 2)
+  if len(args) != 2 {
+    return NewChatError(CodeBadRequest, "Invalid Auth Request")
+  }
+  if string(bytes.ToUpper(args[0])) != ScramMechanism {
+    return NewChatError(CodeAuthDisabled, "Unsupported mechanism, only " + ScramMechanism + " is available")
+  }
+
+  var err error
+  rq.exchange, err = NewScramExchange(string(args[1]))
+  return err
+}
+
+func (rq *AuthStartRequest) Handle(dispatcher *Dispatcher) (*Response, error) {
+  // The challenge is worked out in the background, and we answer after
+  if err := dispatcher.ClientScramStart(rq.client, rq.exchange, rq.finish); err != nil {
+    return nil, err
+  }
+  return nil, nil
+}
+
+func (rq *AuthStartRequest) finish(challenge string, err error) (*Response, error) {
+  if err != nil {
+    return nil, err
+  }
+
+  rs := NewResponse("CHALLENGE")
+  rs.code = CodeContinue
+  rs.AppendString(challenge)
+  return &rs, nil
+}
+
+//////////////////////////////////////////////////
+// Challenge-response login, second half: PROOF client-final-message
+
+type AuthProofRequest struct {
+  Request
+  clientFinal string
+}
+
+func (rq *AuthProofRequest) Create(buf []byte) error {
+  if rq.client.loggedIn {
+    return ErrAlreadyLoggedIn
+  }
+  if len(buf) <= 0 {
+    return NewChatError(CodeBadRequest, "No proof specified")
+  }
+
+  rq.clientFinal = string(buf)
+  return nil
+}
+
+func (rq *AuthProofRequest) Handle(dispatcher *Dispatcher) (*Response, error) {
+  signature, err := dispatcher.ClientScramFinish(rq.client, rq.clientFinal)
+  if err != nil {
+    var rs *Response
+    if _, ok := err.(*DisconnectError); ok {
+      dr := NewFatalErrorResponse(err)
+      rs = &dr
+    } else {
+      er := NewErrorResponse(err)
+      rs = &er
+    }
+    return rs, err
+  }
+
+  rs := NewOkResponse()
+  if rq.client.session != nil {
+    rs.AppendString(rq.client.session.token)
+  }
+  rs.AppendString(signature)
+  return &rs, nil
+}
+
+//////////////////////////////////////////////////
+// Resume a dropped session with the token USER gave us
+
+type ResumeRequest struct {
+  Request
+  token string
+}
+
+func (rq *ResumeRequest) Create(buf []byte) error {
+  if rq.client.loggedIn {
+    return ErrAlreadyLoggedIn
+  }
+  if len(buf) <= 0 {
+    return NewChatError(CodeBadRequest, "No session token specified")
+  }
+
+  rq.token = string(buf)
+  return nil
+}
+
+func (rq *ResumeRequest) Handle(dispatcher *Dispatcher) (*Response, error) {
+  if err := dispatcher.ClientResume(rq.client, rq.token); err != nil {
+    return nil, err
+  }
+
+  rs := NewOkResponse()
+  if rq.client.session != nil {
+    rs.AppendString(rq.client.session.token)
+  }
   return &rs, nil
 }
 
@@ -127,8 +358,18 @@ type UsersRequest struct {
 func (rq *UsersRequest) Handle(dispatcher *Dispatcher) (*Response, error) {
   rs := NewResponse("USERS")
 
+  // Users with several connections are only listed once
+  seen := make(map[string] bool)
   for e := dispatcher.clients.Front(); e != nil; e = e.Next() {
-    rs.AppendString(e.Value.(*Client).username)
+    username := e.Value.(*Client).username
+    if !seen[username] {
+      seen[username] = true
+      if info := dispatcher.clientSet[username]; info != nil && rq.client.Has(CapPresence) {
+        rs.AppendString(info.PresenceString())
+      } else {
+        rs.AppendString(username)
+      }
+    }
   }
 
   return &rs, nil
@@ -161,7 +402,7 @@ type JoinRequest struct {
 
 func (rq *JoinRequest) Create(buf []byte) error {
   if len(buf) <= 0 {
-    return errors.New("No channel specified")
+    return NewChatError(CodeBadRequest, "No channel specified")
   }
   // Ignore @ symbol
   if buf[0] == '@' && len(buf) > 1 {
@@ -169,7 +410,7 @@ func (rq *JoinRequest) Create(buf []byte) error {
   }
   // Require alphanumeric
   if !clientregex.Match(buf) {
-    return errors.New("Invalid characters for channel name")
+    return ErrInvalidChannel
   }
 
   rq.channel = string(buf)
@@ -212,12 +453,16 @@ func (rq *ListRequest) Handle(dispatcher *Dispatcher) (*Response, error) {
   if list := dispatcher.channels[rq.channel]; list != nil {
     rs := NewResponse("LIST")
     for e := list.Front(); e != nil; e = e.Next() {
-      rs.AppendString(e.Value.(*Client).username)
+      if info := e.Value.(*ClientInfo); rq.client.Has(CapPresence) {
+        rs.AppendString(info.PresenceString())
+      } else {
+        rs.AppendString(info.username)
+      }
     }
     return &rs, nil
   }
 
-  return nil, errors.New("Channel does not exist")
+  return nil, ErrNoSuchChannel
 }
 
 //////////////////////////////////////////////////
@@ -226,35 +471,598 @@ func (rq *ListRequest) Handle(dispatcher *Dispatcher) (*Response, error) {
 type SayRequest struct {
   AuthRequest
   Message
+
+  // Set when the target is a comma-separated list
+  targets []string
 }
 
 func (rq *SayRequest) Create(buf []byte) error {
-  msg, err := NewMessage(buf, rq.client)
+  // A ^id after the target makes this a reply
+  var parent uint64
+  if spl := bytes.SplitN(buf, []byte(" "), 3); len(spl) >= 2 && len(spl[1]) > 0 && spl[1][0] == '^' {
+    var err error
+    if parent, err = ParseMessageId(spl[1][1:]); err != nil {
+      return err
+    }
+    buf = bytes.Join(append(spl[:1], spl[2:]...), []byte(" "))
+  }
+
+  // The protocol already framed the text, all that's left is the target
+  if rq.body != nil {
+    if len(buf) <= 0 {
+      return ErrMissingArguments
+    }
+    rq.Message = *NewTextMessage(rq.client.username, string(buf), rq.body)
+  } else {
+    msg, err := NewMessage(buf, rq.client)
+    if err != nil {
+      return err
+    }
+    rq.Message = *msg
+  }
+  rq.parent = parent
+
+  if !strings.Contains(rq.target, ",") {
+    if rq.target == "" {
+      return ErrMissingArguments
+    }
+    return nil
+  }
+
+  // Naming a target twice doesn't get it two copies
+  seen := make(map[string] bool)
+  for _, target := range strings.Split(rq.target, ",") {
+    if target == "" {
+      return NewChatError(CodeBadRequest, "Empty target in list")
+    }
+    if !seen[target] {
+      seen[target] = true
+      rq.targets = append(rq.targets, target)
+    }
+  }
+  return nil
+}
+
+func (rq *SayRequest) Handle(dispatcher *Dispatcher) (*Response, error) {
+  rs := NewOkResponse()
+  if rq.targets == nil {
+    err := dispatcher.SayTo(&rq.Message)
+    if err != nil {
+      return nil, err
+    }
+  } else {
+    // Some targets can fail without the rest failing, so say how each went
+    errs := dispatcher.SayToAll(&rq.Message, rq.targets)
+    for i, target := range rq.targets {
+      code := CodeOk
+      if errs[i] != nil {
+        code = ErrorCode(errs[i])
+      }
+      rs.AppendString(target + "=" + strconv.Itoa(int(code)))
+    }
+  }
+
+  // Random messages feature, which nobody should do in answer to a notice
+  if rq.event != KindNotice && rq.client.messagesSent % 4 >= 3 {
+    // Fetch a random client, out of the ones with a username to send as
+    var loggedIn []*Client
+    for e := dispatcher.clients.Front(); e != nil; e = e.Next() {
+      if client := e.Value.(*Client); client.loggedIn {
+        loggedIn = append(loggedIn, client)
+      }
+    }
+    rmsg, _ := NewRandomMessage(loggedIn[rand.Intn(len(loggedIn))], rq.client)
+    dispatcher.SayTo(rmsg)
+  }
+
+  rq.client.messagesSent++
+
+  return &rs, nil
+}
+
+//////////////////////////////////////////////////
+// ACTION and NOTICE are sent just like SAY
+
+type ActionRequest struct {
+  SayRequest
+}
+
+func (rq *ActionRequest) Create(buf []byte) error {
+  err := rq.SayRequest.Create(buf)
+  rq.event = KindAction
+  return err
+}
+
+type NoticeRequest struct {
+  SayRequest
+}
+
+func (rq *NoticeRequest) Create(buf []byte) error {
+  err := rq.SayRequest.Create(buf)
+  rq.event = KindNotice
+  return err
+}
+
+//////////////////////////////////////////////////
+// HISTORY @channel|user [count] replays a channel's recent messages, or the
+// direct messages with a user, then answers OK
+
+type HistoryRequest struct {
+  JoinRequest
+  user string
+  count int
+}
+
+func (rq *HistoryRequest) Create(buf []byte) error {
+  args := bytes.SplitN(buf, []byte(" "), 2)
+
+  rq.count = HistoryDefaultCount
+  if len(args) == 2 {
+    count, err := strconv.Atoi(string(args[1]))
+    if err != nil || count < 1 {
+      return NewChatError(CodeBadRequest, "Invalid message count")
+    }
+    rq.count = count
+  }
+
+  if len(args[0]) > 0 && args[0][0] != '@' {
+    if !clientregex.Match(args[0]) {
+      return ErrInvalidUsername
+    }
+    rq.user = string(args[0])
+    return nil
+  }
+  return rq.JoinRequest.Create(args[0])
+}
+
+func (rq *HistoryRequest) Handle(dispatcher *Dispatcher) (*Response, error) {
+  var err error
+  if rq.user != "" {
+    err = dispatcher.ClientConversationHistory(rq.client, rq.user, rq.count)
+  } else {
+    err = dispatcher.ClientHistory(rq.client, rq.channel, rq.count)
+  }
   if err != nil {
+    return nil, err
+  }
+
+  rs := NewOkResponse()
+  return &rs, nil
+}
+
+//////////////////////////////////////////////////
+// CONVERSATIONS lists the users you've had direct messages with, latest first,
+// each as user:time:unread
+
+type ConversationsRequest struct {
+  AuthRequest
+}
+
+func (rq *ConversationsRequest) Handle(dispatcher *Dispatcher) (*Response, error) {
+  rs := NewResponse("CONVERSATIONS")
+  for _, conversation := range dispatcher.ClientConversations(rq.client) {
+    rs.AppendString(conversation.Other(rq.client.username) + ":" + unixMillis(conversation.last) + ":" +
+      strconv.Itoa(conversation.Unread(rq.client.username)))
+  }
+  return &rs, nil
+}
+
+//////////////////////////////////////////////////
+// EDIT id text replaces a message's text, framed the same way as SAY's
+
+type EditRequest struct {
+  AuthRequest
+  id uint64
+  text []byte
+}
+
+func (rq *EditRequest) Create(buf []byte) error {
+  idArg := buf
+  if rq.body != nil {
+    rq.text = rq.body
+  } else {
+    // The ID goes where SAY's target would
+    msg, err := NewMessage(buf, rq.client)
+    if err != nil {
+      return err
+    }
+    idArg, rq.text = []byte(msg.target), msg.text
+  }
+
+  var err error
+  rq.id, err = ParseMessageId(idArg)
+  return err
+}
+
+func (rq *EditRequest) Handle(dispatcher *Dispatcher) (*Response, error) {
+  if err := dispatcher.ClientEdit(rq.client, rq.id, rq.text); err != nil {
+    return nil, err
+  }
+
+  rs := NewOkResponse()
+  return &rs, nil
+}
+
+//////////////////////////////////////////////////
+// IdRequest is any request whose only argument is an ID
+
+type IdRequest struct {
+  AuthRequest
+  id uint64
+}
+
+func (rq *IdRequest) Create(buf []byte) error {
+  var err error
+  rq.id, err = ParseMessageId(buf)
+  return err
+}
+
+func ParseMessageId(buf []byte) (uint64, error) {
+  id, err := strconv.ParseUint(string(buf), 10, 64)
+  if err != nil || id == 0 {
+    return 0, NewChatError(CodeBadRequest, "Invalid message ID")
+  }
+  return id, nil
+}
+
+//////////////////////////////////////////////////
+// DELETE id takes a message back
+
+type DeleteRequest struct {
+  IdRequest
+}
+
+func (rq *DeleteRequest) Handle(dispatcher *Dispatcher) (*Response, error) {
+  if err := dispatcher.ClientDelete(rq.client, rq.id); err != nil {
+    return nil, err
+  }
+
+  rs := NewOkResponse()
+  return &rs, nil
+}
+
+//////////////////////////////////////////////////
+// ACK id tells the sender of a direct message that it arrived
+
+type AckRequest struct {
+  IdRequest
+}
+
+func (rq *AckRequest) Handle(dispatcher *Dispatcher) (*Response, error) {
+  if err := dispatcher.ClientAck(rq.client, rq.id); err != nil {
+    return nil, err
+  }
+
+  rs := NewOkResponse()
+  return &rs, nil
+}
+
+//////////////////////////////////////////////////
+// READ id tells the sender that everything up to a direct message was read
+
+type ReadRequest struct {
+  IdRequest
+}
+
+func (rq *ReadRequest) Handle(dispatcher *Dispatcher) (*Response, error) {
+  if err := dispatcher.ClientRead(rq.client, rq.id); err != nil {
+    return nil, err
+  }
+
+  rs := NewOkResponse()
+  return &rs, nil
+}
+
+//////////////////////////////////////////////////
+// THREAD id replays a message and its replies, then answers OK
+
+type ThreadRequest struct {
+  IdRequest
+}
+
+func (rq *ThreadRequest) Handle(dispatcher *Dispatcher) (*Response, error) {
+  if err := dispatcher.ClientThread(rq.client, rq.id); err != nil {
+    return nil, err
+  }
+
+  rs := NewOkResponse()
+  return &rs, nil
+}
+
+//////////////////////////////////////////////////
+// REACT id emoji
+
+// Longest reaction, enough for any emoji with its modifiers
+const MaxReactionLength = 32
+// Most different reactions one message can have, which keeps its reactions=
+// attribute well inside a UDP datagram
+const MaxReactions = 20
+
+type ReactRequest struct {
+  AuthRequest
+  id uint64
+  emoji string
+}
+
+func (rq *ReactRequest) Create(buf []byte) error {
+  args := bytes.SplitN(buf, []byte(" "), 2)
+  if len(args) != 2 {
+    return ErrMissingArguments
+  }
+
+  var err error
+  if rq.id, err = ParseMessageId(args[0]); err != nil {
     return err
   }
-  rq.Message = *msg
+
+  // Reactions go in a reactions=emoji:count,... attribute, which no kind of
+  // space or line break can be allowed to end early
+  emoji := string(args[1])
+  if len(emoji) == 0 || len(emoji) > MaxReactionLength || !utf8.ValidString(emoji) ||
+      strings.ContainsAny(emoji, ":,") || strings.IndexFunc(emoji, func(r rune) bool {
+        return unicode.IsControl(r) || unicode.IsSpace(r)
+      }) >= 0 {
+    return NewChatError(CodeBadRequest, "Invalid reaction")
+  }
+  rq.emoji = emoji
   return nil
 }
 
-func (rq *SayRequest) Handle(dispatcher *Dispatcher) (*Response, error) {
-  err := dispatcher.SayTo(&rq.Message)
+func (rq *ReactRequest) Handle(dispatcher *Dispatcher) (*Response, error) {
+  if err := dispatcher.ClientReact(rq.client, rq.id, rq.emoji); err != nil {
+    return nil, err
+  }
+
+  rs := NewOkResponse()
+  return &rs, nil
+}
+
+//////////////////////////////////////////////////
+// SEARCH [@channel|with=user] [before=id] query sends the newest matching
+// messages, then answers OK with the before= for the next page if there is one
+
+type SearchRequest struct {
+  AuthRequest
+  scope string
+  before uint64
+  query []string
+}
+
+func (rq *SearchRequest) Create(buf []byte) error {
+  args := strings.Fields(string(buf))
+  if len(args) > 1 && args[0][0] == '@' {
+    rq.scope, args = args[0], args[1:]
+  } else if len(args) > 1 && strings.HasPrefix(args[0], "with=") {
+    rq.scope, args = args[0][len("with="):], args[1:]
+    if !clientregex.MatchString(rq.scope) {
+      return NewChatError(CodeInvalidName, "Invalid username")
+    }
+  }
+  if len(args) > 1 && strings.HasPrefix(args[0], "before=") {
+    var err error
+    if rq.before, err = ParseMessageId([]byte(args[0][len("before="):])); err != nil {
+      return err
+    }
+    args = args[1:]
+  }
+
+  rq.query = Words(strings.Join(args, " "))
+  if len(rq.query) == 0 {
+    return NewChatError(CodeBadRequest, "Nothing to search for")
+  }
+  return nil
+}
+
+func (rq *SearchRequest) Handle(dispatcher *Dispatcher) (*Response, error) {
+  next, err := dispatcher.ClientSearch(rq.client, rq.scope, rq.before, rq.query)
   if err != nil {
     return nil, err
   }
 
-  // Random messages feature
-  if rq.client.messagesSent % 4 >= 3 {
-    // Fetch a random client
-    randClient := dispatcher.clients.Front()
-    for i := 0; i < rand.Intn(dispatcher.clients.Len()); i++ {
-      randClient = randClient.Next()
+  rs := NewOkResponse()
+  if next != 0 {
+    rs.AppendString("before=" + strconv.FormatUint(next, 10))
+  }
+  return &rs, nil
+}
+
+//////////////////////////////////////////////////
+// SENDFILE target name size starts an upload, answering OK with the file's ID
+
+// Longest file name
+const MaxFileNameLength = 255
+
+type SendFileRequest struct {
+  AuthRequest
+  target string
+  name string
+  size int
+}
+
+func (rq *SendFileRequest) Create(buf []byte) error {
+  args := strings.Fields(string(buf))
+  if len(args) != 3 {
+    return ErrMissingArguments
+  }
+
+  rq.target, rq.name = args[0], args[1]
+  if len(rq.name) > MaxFileNameLength || !utf8.ValidString(rq.name) || strings.ContainsAny(rq.name, "/\\") {
+    return NewChatError(CodeBadRequest, "Invalid file name")
+  }
+
+  var err error
+  rq.size, err = strconv.Atoi(args[2])
+  if err != nil || rq.size < 1 {
+    return NewChatError(CodeBadRequest, "Invalid file size")
+  }
+  return nil
+}
+
+func (rq *SendFileRequest) Handle(dispatcher *Dispatcher) (*Response, error) {
+  file, err := dispatcher.ClientSendFile(rq.client, rq.target, rq.name, rq.size)
+  if err != nil {
+    return nil, err
+  }
+
+  rs := NewOkResponse()
+  rs.AppendString(strconv.FormatUint(file.id, 10))
+  return &rs, nil
+}
+
+//////////////////////////////////////////////////
+// DATA id offset base64 uploads part of a file, answering OK with how much of
+// the file the server has
+
+type DataRequest struct {
+  AuthRequest
+  id uint64
+  offset int
+  data []byte
+}
+
+func (rq *DataRequest) Create(buf []byte) error {
+  args := strings.Fields(string(buf))
+  if len(args) != 3 {
+    return ErrMissingArguments
+  }
+
+  var err error
+  if rq.id, err = ParseMessageId([]byte(args[0])); err != nil {
+    return err
+  }
+  rq.offset, err = strconv.Atoi(args[1])
+  if err != nil || rq.offset < 0 {
+    return NewChatError(CodeBadRequest, "Invalid offset")
+  }
+  rq.data, err = base64.StdEncoding.DecodeString(args[2])
+  if err != nil {
+    return NewChatError(CodeBadRequest, "Invalid base64 data")
+  }
+  return nil
+}
+
+func (rq *DataRequest) Handle(dispatcher *Dispatcher) (*Response, error) {
+  have, err := dispatcher.ClientFileData(rq.client, rq.id, rq.offset, rq.data)
+  if err != nil {
+    return nil, err
+  }
+
+  rs := NewOkResponse()
+  rs.AppendString(strconv.Itoa(have))
+  return &rs, nil
+}
+
+//////////////////////////////////////////////////
+// GETFILE id sends FILE id size name, the file in DATA lines, then ENDFILE id
+
+type GetFileRequest struct {
+  IdRequest
+}
+
+func (rq *GetFileRequest) Handle(dispatcher *Dispatcher) (*Response, error) {
+  file, err := dispatcher.ClientGetFile(rq.client, rq.id)
+  if err != nil {
+    return nil, err
+  }
+  id := strconv.FormatUint(file.id, 10)
+
+  chunk := FileChunkLength
+  if _, ok := rq.client.Conn.(*FauxConn); ok {
+    chunk = FileDatagramChunkLength
+  }
+
+  header := NewResponse("FILE")
+  header.AppendString(id)
+  header.AppendString(strconv.Itoa(file.size))
+  header.AppendString(file.name)
+  stream := []*Response{&header}
+  for offset := 0; offset < len(file.data); offset += chunk {
+    end := offset + chunk
+    if end > len(file.data) {
+      end = len(file.data)
     }
-    rmsg, _ := NewRandomMessage(randClient.Value.(*Client), rq.client)
-    dispatcher.SayTo(rmsg)
+    data := NewResponse("DATA")
+    data.AppendString(id)
+    data.AppendString(strconv.Itoa(offset))
+    data.AppendString(base64.StdEncoding.EncodeToString(file.data[offset:end]))
+    stream = append(stream, &data)
   }
 
-  rq.client.messagesSent++
+  rs := NewResponse("ENDFILE")
+  rs.AppendString(id)
+  rs.stream = stream
+  return &rs, nil
+}
+
+//////////////////////////////////////////////////
+// STATUS online|away|busy [text] sets your status
+
+type StatusRequest struct {
+  AuthRequest
+  status string
+  text string
+}
+
+func (rq *StatusRequest) Create(buf []byte) error {
+  args := strings.SplitN(string(buf), " ", 2)
+  rq.status = strings.ToLower(args[0])
+  if !ValidStatus(rq.status) {
+    return NewChatError(CodeBadRequest, "Status must be online, away or busy")
+  }
+  if len(args) == 2 {
+    rq.text = args[1]
+  }
+  // The text goes on the end of PRESENCE lines, so it can't break them
+  if len(rq.text) > MaxStatusLength || !utf8.ValidString(rq.text) || strings.IndexFunc(rq.text, unicode.IsControl) >= 0 {
+    return NewChatError(CodeBadRequest, "Invalid status text")
+  }
+  return nil
+}
+
+func (rq *StatusRequest) Handle(dispatcher *Dispatcher) (*Response, error) {
+  dispatcher.ClientStatus(rq.client, rq.status, rq.text)
+
+  rs := NewOkResponse()
+  return &rs, nil
+}
+
+//////////////////////////////////////////////////
+// AWAY [reason] is STATUS away, and a bare AWAY is STATUS online
+
+type AwayRequest struct {
+  StatusRequest
+}
+
+func (rq *AwayRequest) Create(buf []byte) error {
+  if len(buf) <= 0 {
+    return rq.StatusRequest.Create([]byte(StatusOnline))
+  }
+  return rq.StatusRequest.Create(append([]byte(StatusAway + " "), buf...))
+}
+
+//////////////////////////////////////////////////
+// MENTIONS on|off sets whether to hear about mentions in channels you're not
+// in. A bare MENTIONS replays recent ones, then answers OK
+
+type MentionsRequest struct {
+  AuthRequest
+  setting string
+}
+
+func (rq *MentionsRequest) Create(buf []byte) error {
+  rq.setting = strings.ToLower(string(buf))
+  if rq.setting != "" && rq.setting != "on" && rq.setting != "off" {
+    return NewChatError(CodeBadRequest, "MENTIONS takes on or off")
+  }
+  return nil
+}
+
+func (rq *MentionsRequest) Handle(dispatcher *Dispatcher) (*Response, error) {
+  if rq.setting == "" {
+    dispatcher.ClientMentions(rq.client)
+  } else {
+    dispatcher.clientSet[rq.client.username].allMentions = rq.setting == "on"
+  }
 
   rs := NewOkResponse()
   return &rs, nil
@@ -273,18 +1081,56 @@ func (rq *QuitRequest) Handle(dispatcher *Dispatcher) (*Response, error) {
   return &rs, nil
 }
 
+//////////////////////////////////////////////////
+// The connection went away, sent by the client itself on close
+
+type DropRequest struct {
+  Request
+}
+
+func (rq *DropRequest) Handle(dispatcher *Dispatcher) (*Response, error) {
+  dispatcher.ClientDrop(rq.client)
+  rs := NewQuitResponse()
+  return &rs, nil
+}
+
 //////////////////////////////////////////////////
 // Map strings to functions
 
-var Requests = map[string] func() Requestable {
-  "CHAT"  : func() Requestable { return new(Request) },
-  "USER"  : func() Requestable { return new(UserRequest) },
-  "USERS" : func() Requestable { return new(UsersRequest) },
-  "ROOMS" : func() Requestable { return new(RoomsRequest) },
-  "JOIN"  : func() Requestable { return new(JoinRequest) },
-  "PART"  : func() Requestable { return new(PartRequest) },
-  "LIST"  : func() Requestable { return new(ListRequest) },
-  "SAY"   : func() Requestable { return new(SayRequest) },
-  "QUIT"  : func() Requestable { return new(QuitRequest) },
+type RequestType struct {
+  create func() Requestable
+  // Capability the client has to turn on with CHAT first, "" if none
+  capability string
 }
 
+var Requests = map[string] RequestType {
+  "CHAT"  : {func() Requestable { return new(ChatRequest) }, ""},
+  "USER"  : {func() Requestable { return new(UserRequest) }, ""},
+  "AUTH"  : {func() Requestable { return new(AuthStartRequest) }, CapScram},
+  "PROOF" : {func() Requestable { return new(AuthProofRequest) }, CapScram},
+  "RESUME": {func() Requestable { return new(ResumeRequest) }, CapResume},
+  "USERS" : {func() Requestable { return new(UsersRequest) }, ""},
+  "ROOMS" : {func() Requestable { return new(RoomsRequest) }, ""},
+  "JOIN"  : {func() Requestable { return new(JoinRequest) }, ""},
+  "PART"  : {func() Requestable { return new(PartRequest) }, ""},
+  "LIST"  : {func() Requestable { return new(ListRequest) }, ""},
+  "SAY"   : {func() Requestable { return new(SayRequest) }, ""},
+  "ACTION": {func() Requestable { return new(ActionRequest) }, CapKinds},
+  "NOTICE": {func() Requestable { return new(NoticeRequest) }, CapKinds},
+  "HISTORY": {func() Requestable { return new(HistoryRequest) }, CapMsgId},
+  "CONVERSATIONS": {func() Requestable { return new(ConversationsRequest) }, CapReceipts},
+  "THREAD": {func() Requestable { return new(ThreadRequest) }, CapMsgId},
+  "REACT" : {func() Requestable { return new(ReactRequest) }, CapMsgId},
+  "SEARCH": {func() Requestable { return new(SearchRequest) }, CapMsgId},
+  "SENDFILE": {func() Requestable { return new(SendFileRequest) }, CapFiles},
+  "DATA"  : {func() Requestable { return new(DataRequest) }, CapFiles},
+  "GETFILE": {func() Requestable { return new(GetFileRequest) }, CapFiles},
+  "STATUS": {func() Requestable { return new(StatusRequest) }, CapPresence},
+  "AWAY"  : {func() Requestable { return new(AwayRequest) }, CapPresence},
+  "MENTIONS": {func() Requestable { return new(MentionsRequest) }, CapMentions},
+  "EDIT"  : {func() Requestable { return new(EditRequest) }, CapMsgId},
+  "DELETE": {func() Requestable { return new(DeleteRequest) }, CapMsgId},
+  "ACK"   : {func() Requestable { return new(AckRequest) }, CapReceipts},
+  "READ"  : {func() Requestable { return new(ReadRequest) }, CapReceipts},
+  "QUIT"  : {func() Requestable { return new(QuitRequest) }, ""},
+}
@@ -11,17 +11,26 @@ package main
 
 import (
   "fmt"
+  "strconv"
 )
 
 
 type Response struct {
-  data []byte
+  // Copied from the request so the client can tell which one this answers
+  tag string
+
+  keyword string
+  code ReplyCode
+  args [][]byte
   Quit bool // Whether or not this response should cause the client to be disconnected
+
+  // Sent ahead of this one by the client goroutine, so long downloads don't
+  // hold up the dispatcher
+  stream []*Response
 }
 
-func NewResponse(code string) Response {
-  data := append([]byte(code), ' ')
-  return Response{data, false}
+func NewResponse(keyword string) Response {
+  return Response{"", keyword, CodeOk, nil, false, nil}
 }
 
 func NewOkResponse() Response {
@@ -31,6 +40,7 @@ func NewOkResponse() Response {
 
 func NewErrorResponse(err error) Response {
   rs := NewResponse("ERROR")
+  rs.code = ErrorCode(err)
   rs.AppendString(err.Error())
   return rs
 }
@@ -43,6 +53,7 @@ func NewFatalErrorResponse(err error) Response {
 
 func NewQuitResponse() Response {
   rs := NewResponse("TIUQ")
+  rs.code = CodeClosing
   rs.Quit = true
   return rs
 }
@@ -52,19 +63,67 @@ func (rs *Response) AppendString(s string) {
 }
 
 func (rs *Response) Append(data []byte) {
-  data = append(data, ' ')
-  rs.data = append(rs.data, data...)
+  rs.args = append(rs.args, data)
+}
+
+// Tag if any, keyword, reply code if wanted, then the arguments, all space separated
+func (rs *Response) Bytes(codes bool) []byte {
+  var data []byte
+  if rs.tag != "" {
+    data = []byte(rs.tag + " ")
+  }
+  data = append(data, rs.keyword + " "...)
+  if codes {
+    data = append(data, strconv.Itoa(int(rs.code)) + " "...)
+  }
+  for _, arg := range rs.args {
+    data = append(data, arg...)
+    data = append(data, ' ')
+  }
+  return data
 }
 
 func (rs *Response) String() string {
-  return string(rs.data)
+  return string(rs.Bytes(true))
 }
 
 func (rs *Response) WriteTo(c *Client) (n int, err error) {
   if *VerboseMode {
     fmt.Println("SENT to", c.String()+":", rs)
   }
-  rs.data = append(rs.data, "\n"...)
-  return c.Write(rs.data)
+  c.writeMu.Lock()
+  defer c.writeMu.Unlock()
+  for _, part := range rs.parts(c) {
+    wr, err := c.Write(c.protocol.EncodeResponse(c, part))
+    n += wr
+    if err != nil {
+      return n, err
+    }
+  }
+  return n, nil
+}
+
+// Over UDP each response is a datagram of its own, so a long list like USERS
+// is split into several responses with the same keyword, all but the last with
+// CodeContinue. Arguments are never split
+func (rs *Response) parts(c *Client) []*Response {
+  if _, ok := c.Conn.(*FauxConn); !ok || len(c.protocol.EncodeResponse(c, rs)) <= MaxDatagramLength {
+    return []*Response{rs}
+  }
+
+  var parts []*Response
+  part := &Response{rs.tag, rs.keyword, CodeContinue, nil, false, nil}
+  for _, arg := range rs.args {
+    part.args = append(part.args, arg)
+    if len(part.args) > 1 && len(c.protocol.EncodeResponse(c, part)) > MaxDatagramLength {
+      part.args = part.args[:len(part.args)-1]
+      parts = append(parts, part)
+      part = &Response{rs.tag, rs.keyword, CodeContinue, [][]byte{arg}, false, nil}
+    }
+  }
+
+  last := *rs
+  last.args = part.args
+  return append(parts, &last)
 }
 
@@ -0,0 +1,74 @@
+/* Gavin Langdon
+ * Network Programming
+ * Spring 2013
+ * Chat server
+ */
+
+package main
+
+import (
+  "strconv"
+  "strings"
+  "testing"
+)
+
+func udpClient() *Client {
+  cl := (&Dispatcher{}).NewClient(&FauxConn{})
+  cl.caps = map[string] bool{CapCodes: true}
+  return cl
+}
+
+func TestPartsShort(t *testing.T) {
+  rs := NewResponse("USERS")
+  rs.AppendString("alice")
+  rs.AppendString("bob")
+  if parts := rs.parts(udpClient()); len(parts) != 1 || parts[0] != &rs {
+    t.Errorf("short response split into %d parts", len(parts))
+  }
+}
+
+func TestPartsOverTCPNotSplit(t *testing.T) {
+  rs := NewResponse("USERS")
+  for i := 0; i < 500; i++ {
+    rs.AppendString("user" + strconv.Itoa(i))
+  }
+  if parts := rs.parts(pipeClient(t, "")); len(parts) != 1 {
+    t.Errorf("TCP response split into %d parts", len(parts))
+  }
+}
+
+func TestPartsOverUDP(t *testing.T) {
+  cl := udpClient()
+  rs := NewResponse("USERS")
+  rs.tag = "#7"
+  var names []string
+  for i := 0; i < 500; i++ {
+    names = append(names, "user" + strconv.Itoa(i))
+    rs.AppendString(names[i])
+  }
+
+  parts := rs.parts(cl)
+  if len(parts) < 2 {
+    t.Fatalf("%d byte response wasn't split", len(rs.Bytes(true)))
+  }
+  var got []string
+  for i, part := range parts {
+    encoded := cl.protocol.EncodeResponse(cl, part)
+    if len(encoded) > MaxDatagramLength {
+      t.Errorf("part %d is %d bytes", i, len(encoded))
+    }
+    want := CodeContinue
+    if i == len(parts) - 1 {
+      want = CodeOk
+    }
+    if part.code != want || part.keyword != "USERS" || part.tag != "#7" {
+      t.Errorf("part %d starts %q", i, encoded[:20])
+    }
+    for _, arg := range part.args {
+      got = append(got, string(arg))
+    }
+  }
+  if strings.Join(got, " ") != strings.Join(names, " ") {
+    t.Errorf("arguments didn't come back in order")
+  }
+}
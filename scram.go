@@ -0,0 +1,255 @@
+/* Gavin Langdon
+ * Network Programming
+ * Spring 2013
+ * Chat server
+ */
+
+// SCRAM-SHA-256 (RFC 5802, RFC 7677) so clients can log in without sending
+// their password. The client sends
+//
+//   AUTH SCRAM-SHA-256 n,,n=user,r=clientnonce
+//
+// and gets back CHALLENGE r=nonce,s=salt,i=iterations, then answers with
+//
+//   PROOF c=biws,r=nonce,p=proof
+//
+// and gets back OK with its session token and v=serversignature.
+
+package main
+
+import (
+  "crypto/hmac"
+  "crypto/rand"
+  "crypto/sha256"
+  "crypto/subtle"
+  "encoding/base64"
+  "encoding/binary"
+  "errors"
+  "strconv"
+  "strings"
+)
+
+const ScramMechanism = "SCRAM-SHA-256"
+const ScramIterations = 4096
+
+// What the server keeps for a user instead of the password
+type ScramCredentials struct {
+  salt []byte
+  iterations int
+  storedKey []byte
+  serverKey []byte
+}
+
+// Authenticators that can hand out SCRAM credentials support AUTH
+type ScramCredentialSource interface {
+  ScramCredentials(username string) (*ScramCredentials, error)
+}
+
+// An AUTH in progress, kept on the client between AUTH and PROOF
+type ScramExchange struct {
+  username string
+  nonce string
+  gs2Header string
+  clientFirstBare string
+  serverFirst string
+  creds *ScramCredentials
+}
+
+func NewScramCredentials(password []byte) (*ScramCredentials, error) {
+  salt, err := randomBytes(16)
+  if err != nil {
+    return nil, err
+  }
+  return deriveScramCredentials(password, salt, ScramIterations), nil
+}
+
+func deriveScramCredentials(password []byte, salt []byte, iterations int) *ScramCredentials {
+  salted := pbkdf2SHA256(password, salt, iterations)
+  clientKey := hmacSHA256(salted, []byte("Client Key"))
+  storedKey := sha256.Sum256(clientKey)
+  serverKey := hmacSHA256(salted, []byte("Server Key"))
+  return &ScramCredentials{salt, iterations, storedKey[:], serverKey}
+}
+
+// Picked at startup, so salts we make up can't be predicted from outside
+var scramSecret, _ = randomBytes(sha256.Size)
+
+// A salt that's the same every time for a username, so asking twice doesn't
+// give away that we're making it up
+func scramSalt(username string) []byte {
+  return hmacSHA256(scramSecret, []byte("salt " + username))[:16]
+}
+
+// Credentials for a user that doesn't exist, so that the exchange fails at the
+// proof instead of telling the client which usernames are real
+func fakeScramCredentials(username string) *ScramCredentials {
+  key := hmacSHA256(scramSecret, []byte("key " + username))
+  return &ScramCredentials{scramSalt(username), ScramIterations, key, key}
+}
+
+// Parse the PostgreSQL-style SCRAM-SHA-256$iterations:salt$StoredKey:ServerKey
+func ParseScramCredentials(str string) (*ScramCredentials, error) {
+  malformed := errors.New("Malformed SCRAM credentials")
+  if !strings.HasPrefix(str, ScramMechanism + "$") {
+    return nil, malformed
+  }
+  parts := strings.Split(str[len(ScramMechanism)+1:], "$")
+  if len(parts) != 2 {
+    return nil, malformed
+  }
+  iterSalt := strings.SplitN(parts[0], ":", 2)
+  keys := strings.SplitN(parts[1], ":", 2)
+  if len(iterSalt) != 2 || len(keys) != 2 {
+    return nil, malformed
+  }
+
+  var creds ScramCredentials
+  var err error
+  if creds.iterations, err = strconv.Atoi(iterSalt[0]); err != nil || creds.iterations <= 0 {
+    return nil, malformed
+  }
+  if creds.salt, err = base64.StdEncoding.DecodeString(iterSalt[1]); err != nil {
+    return nil, malformed
+  }
+  if creds.storedKey, err = base64.StdEncoding.DecodeString(keys[0]); err != nil {
+    return nil, malformed
+  }
+  if creds.serverKey, err = base64.StdEncoding.DecodeString(keys[1]); err != nil {
+    return nil, malformed
+  }
+  return &creds, nil
+}
+
+// Check a plain password against stored credentials, for USER logins
+func (c *ScramCredentials) Check(password []byte) bool {
+  derived := deriveScramCredentials(password, c.salt, c.iterations)
+  return subtle.ConstantTimeCompare(derived.storedKey, c.storedKey) == 1
+}
+
+// Parse the client-first-message, e.g. n,,n=user,r=nonce
+func NewScramExchange(clientFirst string) (*ScramExchange, error) {
+  malformed := NewChatError(CodeBadRequest, "Malformed SCRAM client-first-message")
+
+  // Channel binding isn't supported, but a client that could use it is fine
+  if !strings.HasPrefix(clientFirst, "n,") && !strings.HasPrefix(clientFirst, "y,") {
+    return nil, malformed
+  }
+  i := strings.Index(clientFirst[2:], ",")
+  if i < 0 {
+    return nil, malformed
+  }
+  headerLen := i + 3
+
+  var ex ScramExchange
+  ex.gs2Header = clientFirst[:headerLen]
+  ex.clientFirstBare = clientFirst[headerLen:]
+
+  attrs := scramAttributes(ex.clientFirstBare)
+  ex.username = attrs["n"]
+  ex.nonce = attrs["r"]
+  if ex.username == "" || ex.nonce == "" {
+    return nil, malformed
+  }
+  if !clientregex.MatchString(ex.username) {
+    return nil, ErrInvalidUsername
+  }
+  return &ex, nil
+}
+
+// Pick the server's half of the nonce and build the server-first-message
+func (ex *ScramExchange) Challenge(creds *ScramCredentials) (string, error) {
+  serverNonce, err := randomBytes(18)
+  if err != nil {
+    return "", err
+  }
+  ex.creds = creds
+  ex.nonce += base64.StdEncoding.EncodeToString(serverNonce)
+  ex.serverFirst = "r=" + ex.nonce +
+    ",s=" + base64.StdEncoding.EncodeToString(creds.salt) +
+    ",i=" + strconv.Itoa(creds.iterations)
+  return ex.serverFirst, nil
+}
+
+// Check the client-final-message and return the server signature for it
+func (ex *ScramExchange) Verify(clientFinal string) (string, error) {
+  i := strings.LastIndex(clientFinal, ",p=")
+  if i < 0 {
+    return "", NewChatError(CodeBadRequest, "Malformed SCRAM client-final-message")
+  }
+  withoutProof := clientFinal[:i]
+  attrs := scramAttributes(withoutProof)
+
+  if attrs["c"] != base64.StdEncoding.EncodeToString([]byte(ex.gs2Header)) {
+    return "", NewChatError(CodeAuthFailed, "SCRAM channel binding mismatch")
+  }
+  if attrs["r"] != ex.nonce {
+    return "", NewChatError(CodeAuthFailed, "SCRAM nonce mismatch")
+  }
+  proof, err := base64.StdEncoding.DecodeString(clientFinal[i+3:])
+  if err != nil || len(proof) != sha256.Size {
+    return "", ErrBadPassword
+  }
+
+  authMessage := []byte(ex.clientFirstBare + "," + ex.serverFirst + "," + withoutProof)
+
+  // Recover the client key from the proof and check it hashes to the stored key
+  clientSignature := hmacSHA256(ex.creds.storedKey, authMessage)
+  clientKey := make([]byte, sha256.Size)
+  for i := range clientKey {
+    clientKey[i] = proof[i] ^ clientSignature[i]
+  }
+  storedKey := sha256.Sum256(clientKey)
+  if subtle.ConstantTimeCompare(storedKey[:], ex.creds.storedKey) != 1 {
+    return "", ErrBadPassword
+  }
+
+  serverSignature := hmacSHA256(ex.creds.serverKey, authMessage)
+  return "v=" + base64.StdEncoding.EncodeToString(serverSignature), nil
+}
+
+// Split a=1,b=2 into a map
+func scramAttributes(str string) map[string] string {
+  attrs := make(map[string] string)
+  for _, attr := range strings.Split(str, ",") {
+    if len(attr) >= 2 && attr[1] == '=' {
+      attrs[attr[:1]] = attr[2:]
+    }
+  }
+  return attrs
+}
+
+func hmacSHA256(key []byte, data []byte) []byte {
+  mac := hmac.New(sha256.New, key)
+  mac.Write(data)
+  return mac.Sum(nil)
+}
+
+// PBKDF2 with HMAC-SHA-256, only the first block since that's all SCRAM needs
+func pbkdf2SHA256(password []byte, salt []byte, iterations int) []byte {
+  mac := hmac.New(sha256.New, password)
+  block := make([]byte, 4)
+  binary.BigEndian.PutUint32(block, 1)
+
+  mac.Write(salt)
+  mac.Write(block)
+  u := mac.Sum(nil)
+  result := append([]byte{}, u...)
+
+  for n := 1; n < iterations; n++ {
+    mac.Reset()
+    mac.Write(u)
+    u = mac.Sum(u[:0])
+    for i := range result {
+      result[i] ^= u[i]
+    }
+  }
+  return result
+}
+
+func randomBytes(n int) ([]byte, error) {
+  buf := make([]byte, n)
+  if _, err := rand.Read(buf); err != nil {
+    return nil, err
+  }
+  return buf, nil
+}
@@ -0,0 +1,110 @@
+/* Gavin Langdon
+ * Network Programming
+ * Spring 2013
+ * Chat server
+ */
+
+package main
+
+import (
+  "encoding/base64"
+  "encoding/hex"
+  "testing"
+)
+
+func TestPbkdf2SHA256(t *testing.T) {
+  tests := []struct {
+    password string
+    salt string
+    iterations int
+    want string
+  }{
+    {"password", "salt", 1, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+    {"password", "salt", 2, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+    {"password", "salt", 4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+  }
+  for _, test := range tests {
+    got := hex.EncodeToString(pbkdf2SHA256([]byte(test.password), []byte(test.salt), test.iterations))
+    if got != test.want {
+      t.Errorf("pbkdf2SHA256(%q, %q, %d) = %s, want %s", test.password, test.salt, test.iterations, got, test.want)
+    }
+  }
+}
+
+// The exchange from RFC 7677 section 3, with the server's half of the nonce
+// filled in by hand instead of by Challenge
+func rfc7677Exchange(t *testing.T) *ScramExchange {
+  ex, err := NewScramExchange("n,,n=user,r=rOprNGfwEbeRWgbNEkqO")
+  if err != nil {
+    t.Fatal(err)
+  }
+  salt, _ := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+  ex.creds = deriveScramCredentials([]byte("pencil"), salt, 4096)
+  ex.nonce = "rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0"
+  ex.serverFirst = "r=" + ex.nonce + ",s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+  return ex
+}
+
+func TestScramVerifyRFC7677(t *testing.T) {
+  ex := rfc7677Exchange(t)
+  signature, err := ex.Verify("c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0," +
+    "p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=")
+  if err != nil {
+    t.Fatal("Verify refused the RFC proof:", err)
+  }
+  if want := "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="; signature != want {
+    t.Errorf("server signature = %s, want %s", signature, want)
+  }
+}
+
+func TestScramVerifyRefuses(t *testing.T) {
+  tests := []struct {
+    name string
+    clientFinal string
+    want error
+  }{
+    {"wrong proof", "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0," +
+      "p=AHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=", ErrBadPassword},
+    {"short proof", "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=AAAA", ErrBadPassword},
+  }
+  for _, test := range tests {
+    if _, err := rfc7677Exchange(t).Verify(test.clientFinal); err != test.want {
+      t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+    }
+  }
+
+  codes := []struct {
+    name string
+    clientFinal string
+    want ReplyCode
+  }{
+    {"no proof", "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0", CodeBadRequest},
+    {"other nonce", "c=biws,r=rOprNGfwEbeRWgbNEkqO," +
+      "p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=", CodeAuthFailed},
+    {"channel binding", "c=eSws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0," +
+      "p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=", CodeAuthFailed},
+  }
+  for _, test := range codes {
+    if _, err := rfc7677Exchange(t).Verify(test.clientFinal); ErrorCode(err) != test.want {
+      t.Errorf("%s: got %v, want code %d", test.name, err, test.want)
+    }
+  }
+}
+
+func TestNewScramExchange(t *testing.T) {
+  for _, bad := range []string{"", "p,,n=user,r=abc", "n,,r=abc", "n,,n=user", "n,,n=us er,r=abc", "n"} {
+    if _, err := NewScramExchange(bad); err == nil {
+      t.Errorf("NewScramExchange(%q) took it", bad)
+    }
+  }
+}
+
+func TestFakeScramCredentialsAreStable(t *testing.T) {
+  a, b := fakeScramCredentials("nobody"), fakeScramCredentials("nobody")
+  if string(a.salt) != string(b.salt) || string(a.storedKey) != string(b.storedKey) {
+    t.Error("fake credentials changed between calls")
+  }
+  if string(a.salt) == string(fakeScramCredentials("somebody").salt) {
+    t.Error("two users got the same fake salt")
+  }
+}
@@ -0,0 +1,80 @@
+/* Gavin Langdon
+ * Network Programming
+ * Spring 2013
+ * Chat server
+ */
+
+// A session outlives its connection for a short grace period so that a client
+// whose connection dropped can RESUME without logging in and rejoining everything
+
+package main
+
+import (
+  "crypto/rand"
+  "encoding/hex"
+  "time"
+)
+
+// How long a dropped session is kept around waiting to be resumed
+const SessionGracePeriod = 2 * time.Minute
+
+// Messages buffered for a dropped session beyond this are discarded
+const SessionBufferSize = 100
+
+type Session struct {
+  token string
+  client *Client
+
+  // Whether the connection has dropped and we're waiting for a resume
+  detached bool
+  expires time.Time
+
+  // Messages received while detached
+  buffer []*Message
+}
+
+func NewSessionToken() (string, error) {
+  buf := make([]byte, 16)
+  if _, err := rand.Read(buf); err != nil {
+    return "", err
+  }
+  return hex.EncodeToString(buf), nil
+}
+
+// Hold on to a message until the session is resumed
+func (s *Session) Buffer(message *Message) {
+  if len(s.buffer) >= SessionBufferSize {
+    s.buffer = s.buffer[1:]
+  }
+  s.buffer = append(s.buffer, message)
+}
+
+// Take a message back out of the buffer. False if it wasn't there
+func (s *Session) Unbuffer(message *Message) bool {
+  for i, buffered := range s.buffer {
+    if buffered == message {
+      s.buffer = append(s.buffer[:i], s.buffer[i+1:]...)
+      return true
+    }
+  }
+  return false
+}
+
+// Whether a message is still waiting to be sent
+func (s *Session) Buffered(message *Message) bool {
+  for _, buffered := range s.buffer {
+    if buffered == message {
+      return true
+    }
+  }
+  return false
+}
+
+func (s *Session) Detach() {
+  s.detached = true
+  s.expires = time.Now().Add(SessionGracePeriod)
+}
+
+func (s *Session) Expired() bool {
+  return s.detached && time.Now().After(s.expires)
+}
@@ -0,0 +1,116 @@
+/* Gavin Langdon
+ * Network Programming
+ * Spring 2013
+ * Chat server
+ */
+
+// Tracks failed logins per username and per source host so that reconnecting
+// doesn't reset the number of tries an attacker gets
+
+package main
+
+import (
+  "fmt"
+  "strconv"
+  "time"
+)
+
+// Failed logins allowed before a lockout kicks in
+const MaxLoginTries = 3
+
+// The first lockout lasts this long; each following lockout doubles it
+const LoginLockoutBase = 30 * time.Second
+const LoginLockoutMax = time.Hour
+
+// A record with no failures for this long is forgotten
+const LoginForgetAfter = 24 * time.Hour
+
+type loginFailures struct {
+  count int
+  lockouts uint
+  lastFailure time.Time
+  lockedUntil time.Time
+}
+
+type LoginThrottle struct {
+  users map[string] *loginFailures
+  hosts map[string] *loginFailures
+}
+
+func NewLoginThrottle() *LoginThrottle {
+  return &LoginThrottle{
+    make(map[string] *loginFailures),
+    make(map[string] *loginFailures)}
+}
+
+// Returns an error if either the username or the host is locked out
+func (t *LoginThrottle) Check(username string, host string) error {
+  now := time.Now()
+  if f := t.users[username]; f != nil && now.Before(f.lockedUntil) {
+    return lockoutError(f.lockedUntil.Sub(now))
+  }
+  if f := t.hosts[host]; f != nil && now.Before(f.lockedUntil) {
+    return lockoutError(f.lockedUntil.Sub(now))
+  }
+  return nil
+}
+
+// Record a failed login against both the username and the host
+func (t *LoginThrottle) Fail(username string, host string) {
+  if d := t.fail(t.users, username); d > 0 {
+    fmt.Println("Locked out user", username, "for", d, "after failed logins from", host)
+  }
+  if d := t.fail(t.hosts, host); d > 0 {
+    fmt.Println("Locked out host", host, "for", d, "after failed logins")
+  }
+}
+
+// A successful login clears the username's record. The host's record is kept
+// so that logging in to one account doesn't reset attempts against others
+func (t *LoginThrottle) Succeed(username string, host string) {
+  delete(t.users, username)
+}
+
+// Forget stale records so the maps don't grow forever
+func (t *LoginThrottle) Prune() {
+  now := time.Now()
+  for _, set := range []map[string] *loginFailures{t.users, t.hosts} {
+    for key, f := range set {
+      if now.Sub(f.lastFailure) > LoginForgetAfter && now.After(f.lockedUntil) {
+        delete(set, key)
+      }
+    }
+  }
+}
+
+// Returns the length of the lockout started by this failure, or 0 if none
+func (t *LoginThrottle) fail(set map[string] *loginFailures, key string) time.Duration {
+  now := time.Now()
+  f := set[key]
+  if f == nil || now.Sub(f.lastFailure) > LoginForgetAfter {
+    f = &loginFailures{}
+    set[key] = f
+  }
+
+  f.lastFailure = now
+  f.count++
+  if f.count < MaxLoginTries {
+    return 0
+  }
+
+  // Exponential lockout window
+  d := LoginLockoutBase << f.lockouts
+  if d > LoginLockoutMax || d <= 0 {
+    d = LoginLockoutMax
+  } else {
+    f.lockouts++
+  }
+  f.count = 0
+  f.lockedUntil = now.Add(d)
+  return d
+}
+
+func lockoutError(d time.Duration) error {
+  secs := int(d / time.Second) + 1
+  return NewChatError(CodeLockedOut, "Too many failed logins. Try again in " + strconv.Itoa(secs) + " seconds")
+}